@@ -0,0 +1,106 @@
+package main
+
+import (
+	"log"
+
+	"github.com/rjected/bazaar/nodeconfig"
+)
+
+// CancelLookupArgs contains the RPC arguments for cancel lookup, which is the
+// buyer id and uuid of the lookup to cancel, and the hop count and route of
+// the cancel message, which is flooded the same way as the lookup.
+type CancelLookupArgs struct {
+	BuyerID  int
+	UUID     int64
+	HopCount int
+	Route    []nodeconfig.Peer
+}
+
+// CancelLookupResponse is empty because no response is required for cancel
+// lookup.
+type CancelLookupResponse struct {
+}
+
+// CancelLookup runs the cancel lookup command.
+func (bnode *BazaarNode) CancelLookup(args CancelLookupArgs, reply *CancelLookupResponse) error {
+	bnode.cancelLookup(args)
+	return nil
+}
+
+// cancelLookup stops the node from forwarding the lookup or replies to it,
+// and floods the cancel message to the node's peers that are not on its route.
+// Every walker of a random walk lookup is cancelled.
+func (bnode *BazaarNode) cancelLookup(args CancelLookupArgs) {
+
+	// a cancel message that reaches the node again is not flooded again,
+	// unless it can go further than before
+	if ok, _ := bnode.cancelled.markSeen(lookupKey{buyerID: args.BuyerID, uuid: args.UUID}, args.HopCount); !ok {
+		return
+	}
+
+	if bnode.VerboseLogging {
+		log.Printf("Node %d cancelled lookup %d from %d", bnode.config.NodeID, args.UUID, args.BuyerID)
+	}
+
+	if args.HopCount == 0 {
+		return
+	}
+
+	args.Route = append(args.Route, bnode.self())
+	for peer, addr := range bnode.config.Peers {
+		peerInRoute := false
+		for _, routePeer := range args.Route {
+			if peer == routePeer.PeerID {
+				peerInRoute = true
+				break
+			}
+		}
+		if peerInRoute {
+			continue
+		}
+
+		go bnode.callCancelLookupRPC(nodeconfig.Peer{PeerID: peer, Addr: addr}, args)
+	}
+}
+
+// cancelBuyerLookup cancels a lookup the buyer sent with hopCount hops, once
+// it stopped collecting replies to it early. The cancel message goes as far as
+// the lookup did. DHT lookups are not cancelled, since they are done by the
+// time the buyer has its replies. Random walk lookups are not cancelled either, since a flood
+// of cancel messages would cost more than the few walkers it could stop.
+func (bnode *BazaarNode) cancelBuyerLookup(uuid int64, hopCount int) {
+	strategy := bnode.searchStrategy()
+	if !bnode.config.CancelLookups || strategy == nodeconfig.SearchDHT || strategy == nodeconfig.SearchRandomWalk {
+		return
+	}
+
+	bnode.cancelLookup(CancelLookupArgs{
+		BuyerID:  bnode.config.NodeID,
+		UUID:     uuid,
+		HopCount: hopCount,
+		Route:    []nodeconfig.Peer{},
+	})
+}
+
+// isCancelled returns true if the buyer cancelled the lookup.
+func (bnode *BazaarNode) isCancelled(buyerID int, uuid int64) bool {
+	return bnode.cancelled.contains(lookupKey{buyerID: buyerID, uuid: uuid})
+}
+
+// countCancelled counts a lookup or reply that the node dropped because the
+// lookup was cancelled, and logs the totals every 100 messages, so the
+// messages saved by cancelling can be measured.
+func (bnode *BazaarNode) countCancelled(isReply bool) {
+	bnode.perfLock.Lock()
+	defer bnode.perfLock.Unlock()
+
+	if isReply {
+		bnode.state.CancelledReplies++
+	} else {
+		bnode.state.CancelledLookups++
+	}
+
+	if (bnode.state.CancelledLookups+bnode.state.CancelledReplies)%100 == 0 {
+		log.Printf("🔎🔎🔎 Node %d has dropped %d lookups and %d replies for cancelled lookups 🔎🔎🔎", bnode.config.NodeID, bnode.state.CancelledLookups, bnode.state.CancelledReplies)
+	}
+}
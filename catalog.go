@@ -0,0 +1,256 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/rjected/bazaar/nodeconfig"
+)
+
+// defaultAdvertiseHops is how many hops a catalog reaches if the node config
+// does not set it.
+const defaultAdvertiseHops = 1
+
+// AdvertiseArgs contains the RPC arguments for advertise, which is the
+// seller's catalog of offers along with a sequence number that orders the
+// seller's catalogs, and when the catalog expires. Hops is how many more times
+// the catalog is forwarded, and Route is the nodes it has already been to,
+// starting at the seller.
+type AdvertiseArgs struct {
+	Seller  nodeconfig.Peer
+	Seq     int64
+	Offers  []Offer
+	Expires time.Time
+	Hops    int
+	Route   []nodeconfig.Peer
+}
+
+// AdvertiseResponse is empty because no response is required for advertise.
+type AdvertiseResponse struct {
+}
+
+// Advertise runs the advertise command, which stores the seller's catalog and
+// forwards it to the node's other peers.
+func (bnode *BazaarNode) Advertise(args AdvertiseArgs, reply *AdvertiseResponse) error {
+	bnode.receiveCatalog(args)
+	return nil
+}
+
+// catalogEntry is the latest catalog a node has from a seller, and how many
+// hops away the seller is.
+type catalogEntry struct {
+	seq     int64
+	hops    int
+	offers  []Offer
+	expires time.Time
+}
+
+// catalogCache holds the catalogs that sellers advertised to a node, so the
+// node can answer lookups without flooding them. This is thread safe.
+type catalogCache struct {
+	entries map[int]catalogEntry
+	lock    *sync.Mutex
+}
+
+// newCatalogCache creates an empty catalog cache.
+func newCatalogCache() *catalogCache {
+	return &catalogCache{
+		entries: make(map[int]catalogEntry),
+		lock:    &sync.Mutex{},
+	}
+}
+
+// update replaces the seller's catalog with the given one, and returns false
+// if the cache already has the same or a newer catalog from the seller. An
+// empty catalog clears the seller's offers.
+func (cache *catalogCache) update(sellerID int, entry catalogEntry) bool {
+	now := time.Now()
+
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+
+	// drop expired catalogs, so the map does not grow forever
+	for seenID, seen := range cache.entries {
+		if now.After(seen.expires) {
+			delete(cache.entries, seenID)
+		}
+	}
+
+	current, ok := cache.entries[sellerID]
+	if ok && current.seq >= entry.seq {
+		return false
+	}
+
+	cache.entries[sellerID] = entry
+	return true
+}
+
+// find returns the offers for the item, from catalogs that have not expired,
+// that pass the filter. Each offer's hops is the distance from this node to
+// the seller.
+func (cache *catalogCache) find(item string, filter nodeconfig.LookupFilter) []Offer {
+	now := time.Now()
+
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+
+	var offers []Offer
+	for sellerID, entry := range cache.entries {
+		if now.After(entry.expires) {
+			continue
+		}
+
+		for _, offer := range entry.offers {
+			if offer.Item != item {
+				continue
+			}
+			if !filter.Allows(sellerID, offer.item()) {
+				continue
+			}
+
+			offer.Hops = entry.hops
+			offers = append(offers, offer)
+		}
+	}
+
+	return offers
+}
+
+// advertiseHops returns how many hops away from the seller its catalog reaches.
+func (bnode *BazaarNode) advertiseHops() int {
+	if bnode.config.AdvertiseHops <= 0 {
+		return defaultAdvertiseHops
+	}
+	return bnode.config.AdvertiseHops
+}
+
+// advertiseTTL returns how long the seller's catalogs are kept by other nodes.
+func (bnode *BazaarNode) advertiseTTL() time.Duration {
+	if bnode.config.AdvertiseTTL <= 0 {
+		return 3 * bnode.config.AdvertiseInterval
+	}
+	return bnode.config.AdvertiseTTL
+}
+
+// advertiseLoop advertises the seller's catalog every advertise interval, and
+// whenever the catalog changes. It is meant to be run in a goroutine, and runs
+// for as long as the node does.
+func (bnode *BazaarNode) advertiseLoop() {
+	ticker := time.NewTicker(bnode.config.AdvertiseInterval)
+	defer ticker.Stop()
+
+	for {
+		bnode.advertise()
+
+		select {
+		case <-ticker.C:
+		case <-bnode.catalogChanged:
+		}
+	}
+}
+
+// invalidateCatalog makes the seller advertise its catalog and register its
+// items in the DHT again, so other nodes drop offers it can no longer fill. It
+// does not block, and can be called with the node lock held.
+func (bnode *BazaarNode) invalidateCatalog() {
+	for _, changed := range []chan struct{}{bnode.catalogChanged, bnode.dhtChanged} {
+		select {
+		case changed <- struct{}{}:
+		default:
+			// an update is already pending
+		}
+	}
+}
+
+// advertise sends the seller's current catalog to its peers.
+func (bnode *BazaarNode) advertise() {
+	self := bnode.self()
+	expires := time.Now().Add(bnode.advertiseTTL())
+
+	offers := bnode.catalog()
+	for i := range offers {
+		offers[i].Seller = self
+		offers[i].Expires = expires
+	}
+
+	if bnode.VerboseLogging {
+		log.Printf("Seller node %d advertising %d offers", bnode.config.NodeID, len(offers))
+	}
+
+	bnode.sendCatalog(AdvertiseArgs{
+		Seller:  self,
+		Seq:     time.Now().UnixNano(),
+		Offers:  offers,
+		Expires: expires,
+		Hops:    bnode.advertiseHops() - 1,
+		Route:   []nodeconfig.Peer{self},
+	})
+}
+
+// catalog returns an offer for every item the seller replies to lookups for,
+// and has in stock or can restock.
+func (bnode *BazaarNode) catalog() []Offer {
+
+	bnode.state.Mu.Lock()
+	defer bnode.state.Mu.Unlock()
+
+	var offers []Offer
+	for _, item := range bnode.config.Items {
+		if !bnode.offersItem(item) || (item.Amount <= 0 && !item.RestocksOnDemand()) {
+			continue
+		}
+
+		offers = append(offers, Offer{
+			Item:      item.Item,
+			Available: item.Amount,
+			Unlimited: item.RestocksOnDemand(),
+			Price:     item.Price,
+		})
+	}
+
+	return offers
+}
+
+// receiveCatalog stores a catalog advertised by a seller, and forwards it if
+// it has hops left and is newer than the catalog the node already has.
+func (bnode *BazaarNode) receiveCatalog(args AdvertiseArgs) {
+	if args.Seller.PeerID == bnode.config.NodeID {
+		return
+	}
+
+	entry := catalogEntry{seq: args.Seq, hops: len(args.Route), offers: args.Offers, expires: args.Expires}
+	if !bnode.catalogs.update(args.Seller.PeerID, entry) {
+		return
+	}
+
+	if bnode.VerboseLogging {
+		log.Printf("Node %d stored %d offers from seller node %d", bnode.config.NodeID, len(args.Offers), args.Seller.PeerID)
+	}
+
+	if args.Hops <= 0 {
+		return
+	}
+
+	args.Hops--
+	args.Route = append(args.Route, bnode.self())
+	bnode.sendCatalog(args)
+}
+
+// sendCatalog sends the catalog to every peer that is not on its route.
+func (bnode *BazaarNode) sendCatalog(args AdvertiseArgs) {
+	for peer, addr := range bnode.config.Peers {
+		peerInRoute := false
+		for _, routePeer := range args.Route {
+			if peer == routePeer.PeerID {
+				peerInRoute = true
+				break
+			}
+		}
+		if peerInRoute {
+			continue
+		}
+
+		go bnode.callAdvertiseRPC(nodeconfig.Peer{PeerID: peer, Addr: addr}, args)
+	}
+}
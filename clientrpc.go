@@ -1,8 +1,11 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
+	"net"
 	"net/rpc"
 	"sync"
 	"time"
@@ -13,107 +16,252 @@ import (
 // getClientForPeer either gets the client for the desired peer, or creates it
 // and returns it if it does not exist. The client returned is also inserted
 // into the node's client map, so future requests will not create a new client.
-// This method is thread-safe.
-func (bnode *BazaarNode) getClientForPeer(peer nodeconfig.Peer) (*rpc.Client, error) {
+// Only one call at a time dials a peer, and calls to the same peer wait for it
+// and use its client, while calls to other peers go ahead. The dial gives up
+// when the context is done. If too many calls to the peer failed in a row, it
+// returns ErrPeerUnavailable without dialing until the peer's backoff has
+// passed. This method is thread-safe.
+func (bnode *BazaarNode) getClientForPeer(ctx context.Context, peer nodeconfig.Peer) (*rpc.Client, error) {
 
 	bnode.peerClientLock.Lock()
+	client, ok := bnode.peerClients[peer.PeerID]
+	dialLock, dialing := bnode.peerDials[peer.PeerID]
+	if !dialing {
+		dialLock = &sync.Mutex{}
+		bnode.peerDials[peer.PeerID] = dialLock
+	}
+	bnode.peerClientLock.Unlock()
+	if ok {
+		return client, nil
+	}
 
-	// unlock when we return
-	defer func(lock *sync.Mutex) {
-		lock.Unlock()
-	}(bnode.peerClientLock)
+	dialLock.Lock()
+	defer dialLock.Unlock()
 
-	client, ok := bnode.peerClients[peer.PeerID]
-	if !ok {
-		// if the peer does not exist, dial the peer and keep the connection
-		// open.
+	// another call may have dialed the peer while this one waited
+	bnode.peerClientLock.Lock()
+	client, ok = bnode.peerClients[peer.PeerID]
+	if ok {
+		bnode.peerClientLock.Unlock()
+		return client, nil
+	}
 
-		newClient, err := rpc.Dial("tcp", peer.Addr)
-		if err != nil {
-			return nil, fmt.Errorf("dailing error in lookup: %s", err)
+	// only one call at a time probes a peer that has been failing
+	health := bnode.peerHealthLocked(peer.PeerID)
+	if health.open() {
+		if health.probing || time.Now().Before(health.retryAt) {
+			bnode.peerClientLock.Unlock()
+			return nil, fmt.Errorf("%w: node %d is backing off from peer %d", ErrPeerUnavailable, bnode.config.NodeID, peer.PeerID)
 		}
+		health.probing = true
+	}
+	bnode.peerClientLock.Unlock()
 
-		// now insert the client!
-		bnode.peerClients[peer.PeerID] = newClient
+	// if the peer does not exist, dial the peer and keep the connection
+	// open.
+	dialer := net.Dialer{Timeout: bnode.dialTimeout()}
+	conn, err := dialer.DialContext(ctx, "tcp", peer.Addr)
 
-		return newClient, nil
+	bnode.peerClientLock.Lock()
+	defer bnode.peerClientLock.Unlock()
+
+	if err != nil {
+		// a dial cut short by the caller's deadline says nothing about the
+		// peer
+		if ctx.Err() != nil {
+			health.probing = false
+		} else {
+			bnode.peerFailedLocked(peer.PeerID, err)
+		}
+		return nil, fmt.Errorf("dailing error in lookup: %s", err)
 	}
+	newClient := rpc.NewClient(conn)
 
-	return client, nil
+	// now insert the client!
+	bnode.peerClients[peer.PeerID] = newClient
+
+	return newClient, nil
 
 }
 
-// callReplyRPC calls the reply RPC with the given routelist to the given peer
-func (bnode *BazaarNode) callReplyRPC(replyPeer nodeconfig.Peer, routeList []nodeconfig.Peer, sellerInfo nodeconfig.Peer, lookupUUID int) {
+// callReplyRPC is meant to be run in a goroutine and call the reply RPC with
+// the given reply to the given peer. It will also take care of reporting
+// latency. A reply that cannot be passed on is lost, so errors are logged
+// rather than fatal.
+func (bnode *BazaarNode) callReplyRPC(replyPeer nodeconfig.Peer, req ReplyArgs) {
 
 	startTime := time.Now()
 
-	// get client
-	client, err := bnode.getClientForPeer(replyPeer)
+	var res ReplyResponse
+	ctx, cancel := bnode.callContext(time.Time{})
+	defer cancel()
+	err := bnode.callPeer(ctx, replyPeer, "node.Reply", req, &res)
 	if err != nil {
-		log.Fatalf("Error getting client during sell call: %s\n", err)
+		log.Printf("reply call error: %s\n", err)
+		return
 	}
 
-	req := ReplyArgs{routeList, sellerInfo, lookupUUID}
+	end := time.Now()
+	bnode.reportRPCLatency(startTime, end, replyPeer.Addr)
+
+}
+
+// callDirectReplyRPC calls the reply RPC with the given reply to the buyer,
+// and reports latency. Unlike callReplyRPC, it returns an error if the buyer
+// cannot be reached, so the reply can be sent along the route instead.
+func (bnode *BazaarNode) callDirectReplyRPC(buyer nodeconfig.Peer, req ReplyArgs) error {
+
+	startTime := time.Now()
+
 	var res ReplyResponse
+	ctx, cancel := bnode.callContext(time.Time{})
+	defer cancel()
+	err := bnode.callPeer(ctx, buyer, "node.Reply", req, &res)
+	if err != nil {
+		return err
+	}
+
+	end := time.Now()
+	bnode.reportRPCLatency(startTime, end, buyer.Addr)
+
+	return nil
+}
+
+// callSellRPC calls the sell RPC to the given node for quantity units of the
+// target item, offering the payment, and reports latency. The request id must
+// be the same for any retries of the purchase. It returns the outcome of the
+// transaction, or an error if nothing was sold. Errors from the seller are
+// returned as the sell errors, such as ErrOutOfStock.
+func (bnode *BazaarNode) callSellRPC(seller nodeconfig.Peer, requestID string, target string, quantity int, payment int) (TransactionResponse, error) {
 
-	err = client.Call("node.Reply", req, &res)
+	start := time.Now()
+
+	req := TransactionArgs{
+		CurrentTarget: target,
+		BuyerID:       bnode.config.NodeID,
+		RequestID:     requestID,
+		Quantity:      quantity,
+		Payment:       payment,
+	}
+	var res TransactionResponse
+
+	ctx, cancel := bnode.callContext(time.Time{})
+	defer cancel()
+	err := bnode.callPeer(ctx, seller, "node.Sell", req, &res)
 	if err != nil {
-		log.Fatalln("reply error: ", err)
+		return TransactionResponse{}, rpcError(err)
 	}
+
 	end := time.Now()
-	bnode.reportRPCLatency(startTime, end, replyPeer.Addr)
+	bnode.reportRPCLatency(start, end, seller.Addr)
+
+	return res, nil
 
 }
 
-// callSellRPC calls the sell RPC to the given node, and reports latency.
-func (bnode *BazaarNode) callSellRPC(seller nodeconfig.Peer) {
+// callReserveRPC calls the reserve RPC to the given node for quantity units of
+// the target item, and reports latency. Errors from the seller are returned as
+// the sell errors, such as ErrNotSeller.
+func (bnode *BazaarNode) callReserveRPC(seller nodeconfig.Peer, target string, quantity int) (ReserveResponse, error) {
 
 	start := time.Now()
 
-	// get client
-	client, err := bnode.getClientForPeer(seller)
+	req := ReserveArgs{Item: target, BuyerID: bnode.config.NodeID, Quantity: quantity}
+	var res ReserveResponse
+
+	ctx, cancel := bnode.callContext(time.Time{})
+	defer cancel()
+	err := bnode.callPeer(ctx, seller, "node.Reserve", req, &res)
 	if err != nil {
-		log.Fatalf("Error getting client during sell call: %s\n", err)
+		return ReserveResponse{}, fmt.Errorf("reserve call error: %w", rpcError(err))
 	}
 
-	req := TransactionArgs{CurrentTarget: bnode.config.BuyerTarget, BuyerID: bnode.config.NodeID}
+	end := time.Now()
+	bnode.reportRPCLatency(start, end, seller.Addr)
+
+	return res, nil
+
+}
+
+// callCommitRPC calls the commit RPC to the given node for the reservation,
+// offering the payment, and reports latency. It returns the outcome of the
+// transaction.
+func (bnode *BazaarNode) callCommitRPC(seller nodeconfig.Peer, reservationID string, payment int) (TransactionResponse, error) {
+
+	start := time.Now()
+
+	req := CommitArgs{ReservationID: reservationID, BuyerID: bnode.config.NodeID, Payment: payment}
 	var res TransactionResponse
 
-	err = client.Call("node.Sell", req, &res)
+	ctx, cancel := bnode.callContext(time.Time{})
+	defer cancel()
+	err := bnode.callPeer(ctx, seller, "node.Commit", req, &res)
 	if err != nil {
-		log.Fatalln("sell call error: ", err)
+		return TransactionResponse{}, fmt.Errorf("commit call error: %w", err)
 	}
 
 	end := time.Now()
 	bnode.reportRPCLatency(start, end, seller.Addr)
 
+	return res, nil
+
 }
 
-// callLookupRPC is meant to be run in a goroutine and call the lookup RPC to the
-// given peer. It will also take care of reporting latency.
-func (bnode *BazaarNode) callLookupRPC(route []nodeconfig.Peer, lookupPeer nodeconfig.Peer, productName string, hopcount, buyerID int, uuid int) {
+// callAbortRPC calls the abort RPC to the given node for the reservation, and
+// reports latency. Reservations expire on their own, so errors are logged
+// rather than fatal.
+func (bnode *BazaarNode) callAbortRPC(seller nodeconfig.Peer, reservationID string) {
 
 	start := time.Now()
 
-	// get client
-	client, err := bnode.getClientForPeer(lookupPeer)
+	req := CommitArgs{ReservationID: reservationID, BuyerID: bnode.config.NodeID}
+	var res AbortResponse
+
+	ctx, cancel := bnode.callContext(time.Time{})
+	defer cancel()
+	err := bnode.callPeer(ctx, seller, "node.Abort", req, &res)
 	if err != nil {
-		log.Fatalf("Error getting client during lookup call: %s\n", err)
+		log.Printf("abort call error: %s\n", err)
+		return
 	}
 
-	req := LookupArgs{
-		ProductName: productName,
-		HopCount:    hopcount - 1,
-		BuyerID:     buyerID,
-		Route:       route,
-		UUID:        uuid,
+	end := time.Now()
+	bnode.reportRPCLatency(start, end, seller.Addr)
+
+}
+
+// callLookupRPC is meant to be run in a goroutine and call the lookup RPC to the
+// given peer. It will also take care of reporting latency. A peer that cannot
+// be reached is left out of the lookup, so errors are logged rather than
+// fatal. Lookups past their deadline are not sent, and the call gives up at
+// the deadline. The lookup is sent with what is left of its budget.
+func (bnode *BazaarNode) callLookupRPC(lookupPeer nodeconfig.Peer, req LookupArgs) {
+
+	// the buyer has stopped waiting for replies to the lookup
+	if req.expired() {
+		bnode.countExpiredLookup(req)
+		return
 	}
-	var res LookupResponse
 
-	err = client.Call("node.Lookup", req, &res)
+	start := time.Now()
+
+	req.HopCount--
+	if !req.deadline.IsZero() {
+		req.Budget = time.Until(req.deadline)
+	}
+	var res LookupResponse
+	bnode.countLookupMessage()
+
+	ctx, cancel := bnode.callContext(req.deadline)
+	defer cancel()
+	err := bnode.callPeer(ctx, lookupPeer, "node.Lookup", req, &res)
+	if errors.Is(err, ErrDeadlinePassed) {
+		bnode.countExpiredLookup(req)
+		return
+	}
 	if err != nil {
-		log.Fatalln("lookup call error: ", err)
+		log.Printf("lookup call error: %s\n", err)
+		return
 	}
 
 	end := time.Now()
@@ -121,8 +269,113 @@ func (bnode *BazaarNode) callLookupRPC(route []nodeconfig.Peer, lookupPeer nodec
 
 }
 
+// callAdvertiseRPC is meant to be run in a goroutine and call the advertise
+// RPC to the given peer. Catalogs are sent again every advertise interval, so
+// errors are logged rather than fatal.
+func (bnode *BazaarNode) callAdvertiseRPC(peer nodeconfig.Peer, req AdvertiseArgs) {
+
+	start := time.Now()
+
+	var res AdvertiseResponse
+	ctx, cancel := bnode.callContext(time.Time{})
+	defer cancel()
+	err := bnode.callPeer(ctx, peer, "node.Advertise", req, &res)
+	if err != nil {
+		log.Printf("advertise call error: %s\n", err)
+		return
+	}
+
+	end := time.Now()
+	bnode.reportRPCLatency(start, end, peer.Addr)
+
+}
+
+// callFindRPC calls the find RPC to the given node in the DHT, and reports
+// latency. The call gives up at the deadline, if it is set.
+func (bnode *BazaarNode) callFindRPC(peer nodeconfig.Peer, req FindArgs, deadline time.Time) (FindResponse, error) {
+
+	start := time.Now()
+
+	var res FindResponse
+	ctx, cancel := bnode.callContext(deadline)
+	defer cancel()
+	err := bnode.callPeer(ctx, peer, "node.Find", req, &res)
+	if err != nil {
+		return FindResponse{}, err
+	}
+
+	end := time.Now()
+	bnode.reportRPCLatency(start, end, peer.Addr)
+
+	return res, nil
+}
+
+// callStoreRPC is meant to be run in a goroutine and call the store RPC to
+// the given node in the DHT. Sellers register their items again every
+// republish interval, so errors are logged rather than fatal.
+func (bnode *BazaarNode) callStoreRPC(peer nodeconfig.Peer, req StoreArgs) {
+
+	start := time.Now()
+
+	var res StoreResponse
+	ctx, cancel := bnode.callContext(time.Time{})
+	defer cancel()
+	err := bnode.callPeer(ctx, peer, "node.Store", req, &res)
+	if err != nil {
+		log.Printf("store call error: %s\n", err)
+		return
+	}
+
+	end := time.Now()
+	bnode.reportRPCLatency(start, end, peer.Addr)
+
+}
+
+// callCancelLookupRPC is meant to be run in a goroutine and call the cancel
+// lookup RPC to the given peer. Cancelling only saves messages, so errors are
+// logged rather than fatal.
+func (bnode *BazaarNode) callCancelLookupRPC(peer nodeconfig.Peer, req CancelLookupArgs) {
+
+	start := time.Now()
+
+	req.HopCount--
+	var res CancelLookupResponse
+	ctx, cancel := bnode.callContext(time.Time{})
+	defer cancel()
+	err := bnode.callPeer(ctx, peer, "node.CancelLookup", req, &res)
+	if err != nil {
+		log.Printf("cancel lookup call error: %s\n", err)
+		return
+	}
+
+	end := time.Now()
+	bnode.reportRPCLatency(start, end, peer.Addr)
+
+}
+
+// callGossipReputationRPC is meant to be run in a goroutine and call the
+// gossip reputation RPC to the given peer. Ratings are gossiped again every
+// gossip interval, so errors are logged rather than fatal.
+func (bnode *BazaarNode) callGossipReputationRPC(peer nodeconfig.Peer, req ReputationGossipArgs) {
+
+	start := time.Now()
+
+	var res ReputationGossipResponse
+	ctx, cancel := bnode.callContext(time.Time{})
+	defer cancel()
+	err := bnode.callPeer(ctx, peer, "node.GossipReputation", req, &res)
+	if err != nil {
+		log.Printf("gossip reputation call error: %s\n", err)
+		return
+	}
+
+	end := time.Now()
+	bnode.reportRPCLatency(start, end, peer.Addr)
+
+}
+
 // AddLookupTime given the uuid, adds the current time to the perf map.
-func (bnode *BazaarNode) AddLookupTime(uuid int) {
+func (bnode *BazaarNode) AddLookupTime(uuid int64) {
 	end := time.Now()
 	bnode.perfLock.Lock()
 	_, ok := bnode.perfMap[uuid]
@@ -137,7 +390,7 @@ func (bnode *BazaarNode) AddLookupTime(uuid int) {
 }
 
 // GetEarliestLookup gets the earliest time for the given uuid
-func (bnode *BazaarNode) GetEarliestLookup(uuid int) (time.Time, error) {
+func (bnode *BazaarNode) GetEarliestLookup(uuid int64) (time.Time, error) {
 	var earliest time.Time
 	bnode.perfLock.Lock()
 	defer bnode.perfLock.Unlock()
@@ -148,12 +401,16 @@ func (bnode *BazaarNode) GetEarliestLookup(uuid int) (time.Time, error) {
 	return earliest, nil
 }
 
-// GetLookupUUID generates a lookup uuid. This is thread safe.
-func (bnode *BazaarNode) GetLookupUUID() int {
-	var uuid int
+// GetLookupUUID generates a lookup uuid, which is unique across nodes. The
+// node id is in the upper 32 bits, and a counter is in the lower 32 bits, so
+// uuids are 64 bits on every platform. The counter starts at a random value,
+// so a restarted node does not reuse the uuids of its earlier lookups. This is
+// thread safe.
+func (bnode *BazaarNode) GetLookupUUID() int64 {
+	var counter uint32
 	bnode.uuidLock.Lock()
-	uuid = bnode.lookupUUID
+	counter = bnode.lookupUUID
 	bnode.lookupUUID++
 	bnode.uuidLock.Unlock()
-	return uuid
+	return int64(bnode.config.NodeID)<<32 | int64(counter)
 }
@@ -12,6 +12,22 @@ type NetworkConfig struct {
 	MaxHops   int    `yaml:"maxHops"`
 	OutputDir string `yaml:"outputDir"`
 
+	// search strategy and number of random walkers for the whole network,
+	// unless a static node sets its own
+	Search  string `yaml:"search,omitempty"`
+	Walkers int    `yaml:"walkers,omitempty"`
+
+	// expandingRing makes every buyer in the network use expanding ring
+	// lookups
+	ExpandingRing bool `yaml:"expandingRing,omitempty"`
+
+	// cancelLookups makes every buyer in the network cancel its lookups once
+	// it picks a seller
+	CancelLookups bool `yaml:"cancelLookups,omitempty"`
+
+	// directReply makes every seller in the network reply straight to buyers
+	DirectReply bool `yaml:"directReply,omitempty"`
+
 	// includeEdges is a list of edges to include in the network, from nodes
 	// that have already been named and specified.
 	// excludeEdges is a list of edges to specifically exclude, and not connect
@@ -145,6 +145,21 @@ func main() {
 		temp.NodeID = k
 		temp.MaxPeers = netConf.K
 		temp.MaxHops = netConf.MaxHops
+		if temp.Search == "" {
+			temp.Search = netConf.Search
+		}
+		if temp.Walkers == 0 {
+			temp.Walkers = netConf.Walkers
+		}
+		if netConf.ExpandingRing {
+			temp.ExpandingRing = true
+		}
+		if netConf.CancelLookups {
+			temp.CancelLookups = true
+		}
+		if netConf.DirectReply {
+			temp.DirectReply = true
+		}
 
 		// if we have any hosts, always assign node IPs by the host list.
 		// otherwise use localhost
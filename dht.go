@@ -0,0 +1,439 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"log"
+	"math/bits"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/rjected/bazaar/nodeconfig"
+)
+
+// dhtK is how many contacts a routing table bucket holds, and how many of the
+// closest nodes a seller registers with.
+const dhtK = 8
+
+// dhtAlpha is how many nodes a DHT lookup queries at the same time.
+const dhtAlpha = 3
+
+// defaultDHTRepublish is how often a seller registers its items in the DHT if
+// the node config does not set it.
+const defaultDHTRepublish = 10 * time.Second
+
+// dhtKey is a key in the DHT. Node ids and product names are hashed to keys,
+// and the distance between two keys is their XOR.
+type dhtKey [sha1.Size]byte
+
+// nodeKey returns the DHT key of the node with the given id.
+func nodeKey(nodeID int) dhtKey {
+	return sha1.Sum([]byte("node:" + strconv.Itoa(nodeID)))
+}
+
+// itemKey returns the DHT key that sellers of the item register under.
+func itemKey(item string) dhtKey {
+	return sha1.Sum([]byte("item:" + item))
+}
+
+// distance returns the XOR distance between two keys.
+func (key dhtKey) distance(other dhtKey) dhtKey {
+	var dist dhtKey
+	for i := range key {
+		dist[i] = key[i] ^ other[i]
+	}
+	return dist
+}
+
+// closer returns true if a is closer to the key than b.
+func (key dhtKey) closer(a, b dhtKey) bool {
+	distA := key.distance(a)
+	distB := key.distance(b)
+	return bytes.Compare(distA[:], distB[:]) < 0
+}
+
+// bucket returns the index of the routing table bucket for the other key,
+// which is the number of leading bits the keys share. It returns -1 for the
+// key itself.
+func (key dhtKey) bucket(other dhtKey) int {
+	dist := key.distance(other)
+	for i, b := range dist {
+		if b != 0 {
+			return i*8 + bits.LeadingZeros8(b)
+		}
+	}
+	return -1
+}
+
+// routingTable is a Kademlia routing table, with a bucket of up to dhtK
+// contacts for every distance from the node. Full buckets keep their oldest
+// contacts, since long lived nodes are the most likely to stay up. This is
+// thread safe.
+type routingTable struct {
+	self    dhtKey
+	buckets [sha1.Size * 8][]nodeconfig.Peer
+	lock    *sync.Mutex
+}
+
+// newRoutingTable creates an empty routing table for the node with the given
+// id.
+func newRoutingTable(nodeID int) *routingTable {
+	return &routingTable{
+		self: nodeKey(nodeID),
+		lock: &sync.Mutex{},
+	}
+}
+
+// add adds the peer to the routing table, or moves it to the back of its
+// bucket if it is already there.
+func (table *routingTable) add(peer nodeconfig.Peer) {
+	idx := table.self.bucket(nodeKey(peer.PeerID))
+	if idx == -1 {
+		return
+	}
+
+	table.lock.Lock()
+	defer table.lock.Unlock()
+
+	bucket := table.buckets[idx]
+	for i, contact := range bucket {
+		if contact.PeerID == peer.PeerID {
+			bucket = append(bucket[:i], bucket[i+1:]...)
+			break
+		}
+	}
+	if len(bucket) < dhtK {
+		bucket = append(bucket, peer)
+	}
+	table.buckets[idx] = bucket
+}
+
+// closest returns up to n contacts that are closest to the key.
+func (table *routingTable) closest(key dhtKey, n int) []nodeconfig.Peer {
+	table.lock.Lock()
+	var contacts []nodeconfig.Peer
+	for _, bucket := range table.buckets {
+		contacts = append(contacts, bucket...)
+	}
+	table.lock.Unlock()
+
+	sortByDistance(key, contacts)
+	if len(contacts) > n {
+		contacts = contacts[:n]
+	}
+	return contacts
+}
+
+// sortByDistance sorts the peers from closest to the key to furthest.
+func sortByDistance(key dhtKey, peers []nodeconfig.Peer) {
+	sort.Slice(peers, func(i, j int) bool {
+		return key.closer(nodeKey(peers[i].PeerID), nodeKey(peers[j].PeerID))
+	})
+}
+
+// dhtStore holds the offers sellers registered with this node, by key and
+// then by seller id. This is thread safe.
+type dhtStore struct {
+	records map[dhtKey]map[int]Offer
+	lock    *sync.Mutex
+}
+
+// newDHTStore creates an empty DHT store.
+func newDHTStore() *dhtStore {
+	return &dhtStore{
+		records: make(map[dhtKey]map[int]Offer),
+		lock:    &sync.Mutex{},
+	}
+}
+
+// put replaces the seller's offer under the key. An offer that has already
+// expired removes the seller's offer instead.
+func (store *dhtStore) put(key dhtKey, offer Offer) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	offers, ok := store.records[key]
+	if !ok {
+		offers = make(map[int]Offer)
+		store.records[key] = offers
+	}
+
+	if offer.Expired() {
+		delete(offers, offer.Seller.PeerID)
+	} else {
+		offers[offer.Seller.PeerID] = offer
+	}
+	if len(offers) == 0 {
+		delete(store.records, key)
+	}
+}
+
+// get returns the offers under the key that have not expired.
+func (store *dhtStore) get(key dhtKey) []Offer {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	var offers []Offer
+	for sellerID, offer := range store.records[key] {
+		if offer.Expired() {
+			delete(store.records[key], sellerID)
+			continue
+		}
+		offers = append(offers, offer)
+	}
+	return offers
+}
+
+// FindArgs contains the RPC arguments for find, which is the node sending the
+// request, the key it is looking for, and whether it wants the offers stored
+// under the key or only the contacts closest to it.
+type FindArgs struct {
+	Sender nodeconfig.Peer
+	Key    dhtKey
+	Value  bool
+}
+
+// FindResponse contains the offers stored under the key, if they were asked
+// for and the node has any. Otherwise it contains the contacts the node knows
+// that are closest to the key.
+type FindResponse struct {
+	Offers   []Offer
+	Contacts []nodeconfig.Peer
+}
+
+// StoreArgs contains the RPC arguments for store, which is the node sending
+// the request, and the seller's offer to store under the key.
+type StoreArgs struct {
+	Sender nodeconfig.Peer
+	Key    dhtKey
+	Offer  Offer
+}
+
+// StoreResponse is empty because no response is required for store.
+type StoreResponse struct {
+}
+
+// Find runs the find command.
+func (bnode *BazaarNode) Find(args FindArgs, reply *FindResponse) error {
+	bnode.routes.add(args.Sender)
+
+	if args.Value {
+		offers := bnode.dhtRecords.get(args.Key)
+		if len(offers) != 0 {
+			*reply = FindResponse{Offers: offers}
+			return nil
+		}
+	}
+
+	*reply = FindResponse{Contacts: bnode.routes.closest(args.Key, dhtK)}
+	return nil
+}
+
+// Store runs the store command.
+func (bnode *BazaarNode) Store(args StoreArgs, reply *StoreResponse) error {
+	bnode.routes.add(args.Sender)
+	bnode.dhtRecords.put(args.Key, args.Offer)
+	return nil
+}
+
+// dhtRepublish returns how often the seller registers its items in the DHT.
+func (bnode *BazaarNode) dhtRepublish() time.Duration {
+	if bnode.config.DHTRepublish <= 0 {
+		return defaultDHTRepublish
+	}
+	return bnode.config.DHTRepublish
+}
+
+// self returns this node as a peer.
+func (bnode *BazaarNode) self() nodeconfig.Peer {
+	return nodeconfig.Peer{PeerID: bnode.config.NodeID, Addr: net.JoinHostPort(bnode.config.NodeIP, strconv.Itoa(bnode.config.NodePort))}
+}
+
+// dhtFind looks for the nodes closest to the key, asking dhtAlpha nodes at a
+// time for contacts closer to the key until it has asked the dhtK closest
+// nodes it knows of. If value is true, it stops at the first node that has
+// offers stored under the key, and returns them. If the deadline is set, each
+// request gives up at the deadline, and no more rounds are started once it has
+// passed. It also returns the closest nodes it found, and how many rounds of
+// requests it took.
+func (bnode *BazaarNode) dhtFind(key dhtKey, value bool, deadline time.Time) ([]Offer, []nodeconfig.Peer, int) {
+
+	if value {
+		offers := bnode.dhtRecords.get(key)
+		if len(offers) != 0 {
+			return offers, nil, 0
+		}
+	}
+
+	self := bnode.self()
+	queried := map[int]bool{self.PeerID: true}
+	known := map[int]bool{self.PeerID: true}
+	shortlist := bnode.routes.closest(key, dhtK)
+	for _, peer := range shortlist {
+		known[peer.PeerID] = true
+	}
+
+	rounds := 0
+	for {
+		if !deadline.IsZero() && time.Now().After(deadline) {
+			return nil, shortlist, rounds
+		}
+
+		// ask the closest nodes that have not been asked yet
+		var next []nodeconfig.Peer
+		for _, peer := range shortlist {
+			if !queried[peer.PeerID] {
+				next = append(next, peer)
+				queried[peer.PeerID] = true
+			}
+			if len(next) == dhtAlpha {
+				break
+			}
+		}
+		if len(next) == 0 {
+			return nil, shortlist, rounds
+		}
+		rounds++
+
+		responses := make([]FindResponse, len(next))
+		var wg sync.WaitGroup
+		for i, peer := range next {
+			wg.Add(1)
+			go func(i int, peer nodeconfig.Peer) {
+				defer wg.Done()
+				res, err := bnode.callFindRPC(peer, FindArgs{Sender: self, Key: key, Value: value}, deadline)
+				if err != nil {
+					if bnode.VerboseLogging {
+						log.Printf("Node %d could not reach node %d in the DHT: %s", bnode.config.NodeID, peer.PeerID, err)
+					}
+					return
+				}
+				bnode.routes.add(peer)
+				responses[i] = res
+			}(i, peer)
+		}
+		wg.Wait()
+
+		// several nodes store the same offers, so only keep one per seller
+		var offers []Offer
+		sellers := make(map[int]bool)
+		for _, res := range responses {
+			for _, offer := range res.Offers {
+				if !sellers[offer.Seller.PeerID] {
+					sellers[offer.Seller.PeerID] = true
+					offers = append(offers, offer)
+				}
+			}
+			for _, contact := range res.Contacts {
+				if !known[contact.PeerID] {
+					known[contact.PeerID] = true
+					shortlist = append(shortlist, contact)
+				}
+			}
+		}
+		if len(offers) != 0 {
+			return offers, shortlist, rounds
+		}
+
+		sortByDistance(key, shortlist)
+		if len(shortlist) > dhtK {
+			shortlist = shortlist[:dhtK]
+		}
+	}
+}
+
+// dhtLookup looks the product up in the DHT, and hands the offers that pass
+// the lookup filter to the buyer. An offer's hops is how many rounds of
+// requests it took to find. Offers found after the lookup's deadline are
+// dropped.
+func (bnode *BazaarNode) dhtLookup(args LookupArgs) {
+	offers, _, rounds := bnode.dhtFind(itemKey(args.ProductName), true, args.deadline)
+	if args.expired() {
+		bnode.countExpiredLookup(args)
+		return
+	}
+
+	for _, offer := range offers {
+		if offer.Item != args.ProductName || offer.Expired() || !args.Filter.Allows(offer.Seller.PeerID, offer.item()) {
+			continue
+		}
+
+		offer.Hops = rounds
+		bnode.reply(ReplyArgs{RouteList: []nodeconfig.Peer{bnode.self()}, Offer: offer, LookupUUID: args.UUID, Trace: args.Trace})
+	}
+}
+
+// dhtLoop joins the DHT by looking up the node's own key, and then registers
+// the seller's items every republish interval, and whenever its catalog
+// changes. It is meant to be run in a goroutine, and runs for as long as the
+// node does.
+func (bnode *BazaarNode) dhtLoop() {
+	// wait for the other nodes to start
+	time.Sleep(time.Second)
+
+	_, closest, _ := bnode.dhtFind(bnode.routes.self, false, time.Time{})
+	log.Printf("Node %d joined the DHT with %d close nodes", bnode.config.NodeID, len(closest))
+
+	if bnode.config.Role != "seller" && bnode.config.Role != "both" {
+		return
+	}
+
+	ticker := time.NewTicker(bnode.dhtRepublish())
+	defer ticker.Stop()
+
+	published := make(map[string]bool)
+	for {
+		published = bnode.dhtPublish(published)
+
+		select {
+		case <-ticker.C:
+		case <-bnode.dhtChanged:
+		}
+	}
+}
+
+// dhtPublish registers the seller's offers with the nodes closest to each
+// item's key, and withdraws the items that were published before and are no
+// longer in the catalog. It returns the items it published.
+func (bnode *BazaarNode) dhtPublish(published map[string]bool) map[string]bool {
+	self := bnode.self()
+	now := time.Now()
+
+	offers := bnode.catalog()
+	current := make(map[string]bool)
+	for i := range offers {
+		offers[i].Seller = self
+		offers[i].Expires = now.Add(3 * bnode.dhtRepublish())
+		current[offers[i].Item] = true
+	}
+
+	// an offer that has already expired removes the item
+	for item := range published {
+		if !current[item] {
+			offers = append(offers, Offer{Seller: self, Item: item, Expires: now})
+		}
+	}
+
+	for _, offer := range offers {
+		key := itemKey(offer.Item)
+		_, closest, _ := bnode.dhtFind(key, false, time.Time{})
+
+		// this node keeps the offer too if it is one of the closest nodes
+		if len(closest) < dhtK || key.closer(bnode.routes.self, nodeKey(closest[len(closest)-1].PeerID)) {
+			bnode.dhtRecords.put(key, offer)
+		}
+
+		for _, peer := range closest {
+			go bnode.callStoreRPC(peer, StoreArgs{Sender: self, Key: key, Offer: offer})
+		}
+	}
+
+	if bnode.VerboseLogging {
+		log.Printf("Seller node %d registered %d items in the DHT", bnode.config.NodeID, len(current))
+	}
+
+	return current
+}
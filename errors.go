@@ -0,0 +1,86 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/rpc"
+	"strings"
+)
+
+// Errors returned by the sell RPC. They keep their identity across the RPC
+// boundary, so buyers can check for them with errors.Is.
+var (
+	// ErrUnknownItem means the seller does not stock the requested item.
+	ErrUnknownItem = errors.New("unknown item")
+
+	// ErrNotSeller means the node asked to sell is not a seller.
+	ErrNotSeller = errors.New("not a seller")
+
+	// ErrOutOfStock means the seller stocks the item, but has none left.
+	ErrOutOfStock = errors.New("out of stock")
+
+	// ErrInvalidBuyer means the buyer id in the request is not valid.
+	ErrInvalidBuyer = errors.New("invalid buyer")
+
+	// ErrInsufficientFunds means the payment does not cover a single unit of
+	// the item.
+	ErrInsufficientFunds = errors.New("insufficient funds")
+
+	// ErrNoReservation means the reservation being committed does not exist,
+	// for example because it expired.
+	ErrNoReservation = errors.New("no reservation")
+)
+
+// sellErrors are the errors that rpcError recognizes.
+var sellErrors = []error{ErrUnknownItem, ErrNotSeller, ErrOutOfStock, ErrInvalidBuyer, ErrInsufficientFunds, ErrNoReservation}
+
+// statusError returns the error for an unsuccessful transaction status, or nil
+// if the status is not an error.
+func statusError(status TransactionStatus) error {
+	switch status {
+	case StatusUnknownItem:
+		return ErrUnknownItem
+	case StatusSoldOut:
+		return ErrOutOfStock
+	case StatusInsufficientFunds:
+		return ErrInsufficientFunds
+	case StatusNoReservation:
+		return ErrNoReservation
+	default:
+		return nil
+	}
+}
+
+// rpcError turns an error returned by a remote RPC method back into one of the
+// sell errors, if it is one. net/rpc only sends the error message, so this
+// matches on the start of the message.
+func rpcError(err error) error {
+	var serverErr rpc.ServerError
+	if !errors.As(err, &serverErr) {
+		return err
+	}
+
+	for _, sellErr := range sellErrors {
+		if strings.HasPrefix(string(serverErr), sellErr.Error()) {
+			return fmt.Errorf("%w%s", sellErr, strings.TrimPrefix(string(serverErr), sellErr.Error()))
+		}
+	}
+
+	return err
+}
+
+// ErrRPCTimeout means a peer did not answer an RPC call in time.
+var ErrRPCTimeout = errors.New("rpc timed out")
+
+// ErrDeadlinePassed means a call was cut off at the caller's deadline, before
+// the node's call timeout, so it says nothing about the peer.
+var ErrDeadlinePassed = errors.New("deadline passed")
+
+// ErrPeerUnavailable means the node is not calling a peer for a while, because
+// too many calls to it failed in a row.
+var ErrPeerUnavailable = errors.New("peer unavailable")
+
+// ErrOutcomeUnknown means the node sent a request to buy from a seller, but
+// never heard back whether the seller sold anything, so the payment may or may
+// not have been spent.
+var ErrOutcomeUnknown = errors.New("outcome unknown")
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// The kinds of entries recorded in a ledger.
+const (
+	// LedgerSale is recorded by a seller when it sells an item.
+	LedgerSale = "sale"
+
+	// LedgerRestock is recorded by a seller when it restocks an item.
+	LedgerRestock = "restock"
+
+	// LedgerPurchase is recorded by a buyer when it buys an item.
+	LedgerPurchase = "purchase"
+
+	// LedgerPending is recorded by a buyer when it paid a seller, but does
+	// not know if the seller sold anything. The payment stays withdrawn
+	// until a LedgerSettled entry for the same request gives it back.
+	LedgerPending = "pending"
+
+	// LedgerSettled is recorded by a buyer once the seller answers the
+	// request of a pending payment. It gives the payment back, and what the
+	// seller charged is recorded as a purchase.
+	LedgerSettled = "settled"
+)
+
+// LedgerEntry is a single transaction recorded in a node's ledger.
+// Counterparty is the buyer for a sale and the seller for a purchase. Request
+// is the sell request or reservation a pending payment was made for.
+type LedgerEntry struct {
+	Kind         string    `json:"kind"`
+	Time         time.Time `json:"time"`
+	Item         string    `json:"item"`
+	Quantity     int       `json:"quantity"`
+	Price        int       `json:"price,omitempty"`
+	Counterparty int       `json:"counterparty,omitempty"`
+	ReceiptID    string    `json:"receipt,omitempty"`
+	Request      string    `json:"request,omitempty"`
+}
+
+// Ledger is an append-only file of ledger entries, one JSON object per line.
+// Every entry is synced to disk before Append returns. This is thread safe.
+type Ledger struct {
+	file *os.File
+	lock *sync.Mutex
+}
+
+// OpenLedger opens the ledger at the given path, creating it if it does not
+// exist, and returns it along with the entries that are already in it.
+func OpenLedger(path string) (*Ledger, []LedgerEntry, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0666)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// offset is the end of the last complete entry
+	var offset int64
+	var entries []LedgerEntry
+	reader := bufio.NewReader(file)
+	for line := 1; ; line++ {
+		data, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			// a crash during a write can leave a partial last line, which
+			// is cut off so new entries start on a fresh line. An entry is
+			// only complete once its newline is written, so this is done
+			// even if the partial line happens to be valid JSON.
+			if len(data) != 0 {
+				log.Printf("Dropping partial ledger entry on line %d of %s", line, path)
+				err = file.Truncate(offset)
+				if err != nil {
+					file.Close()
+					return nil, nil, fmt.Errorf("error dropping partial ledger entry: %s", err)
+				}
+			}
+			break
+		}
+		if err != nil {
+			file.Close()
+			return nil, nil, fmt.Errorf("error reading ledger: %s", err)
+		}
+
+		// a complete line that is not an entry is corruption
+		var entry LedgerEntry
+		err = json.Unmarshal(data, &entry)
+		if err != nil {
+			file.Close()
+			return nil, nil, fmt.Errorf("error reading ledger entry on line %d: %s", line, err)
+		}
+
+		offset += int64(len(data))
+		entries = append(entries, entry)
+	}
+
+	return &Ledger{file: file, lock: &sync.Mutex{}}, entries, nil
+}
+
+// Append writes the entry to the end of the ledger and syncs it to disk.
+func (ledger *Ledger) Append(entry LedgerEntry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	ledger.lock.Lock()
+	defer ledger.lock.Unlock()
+
+	_, err = ledger.file.Write(line)
+	if err != nil {
+		return err
+	}
+
+	return ledger.file.Sync()
+}
+
+// Close closes the ledger file.
+func (ledger *Ledger) Close() error {
+	return ledger.file.Close()
+}
+
+// record appends the entry to the node's ledger, if the node keeps one.
+// Failing to record is logged rather than failing the transaction, since the
+// transaction has already happened.
+func (bnode *BazaarNode) record(entry LedgerEntry) {
+	if bnode.ledger == nil {
+		return
+	}
+
+	entry.Time = time.Now()
+	err := bnode.ledger.Append(entry)
+	if err != nil {
+		log.Printf("Node %d failed to record %s of %s in ledger: %s", bnode.config.NodeID, entry.Kind, entry.Item, err)
+	}
+}
+
+// replayLedger applies the ledger entries to the node's items and balance, and
+// picks a new seller target if the current one is no longer available.
+func (bnode *BazaarNode) replayLedger(entries []LedgerEntry) {
+
+	bnode.state.Mu.Lock()
+	defer bnode.state.Mu.Unlock()
+
+	pending := make(map[string]LedgerEntry)
+	for _, entry := range entries {
+		switch entry.Kind {
+		case LedgerSale, LedgerRestock:
+			targetID := bnode.findItem(entry.Item)
+			if targetID == -1 {
+				log.Printf("Node %d skipping ledger %s of %s, which it does not stock", bnode.config.NodeID, entry.Kind, entry.Item)
+				continue
+			}
+
+			if entry.Kind == LedgerSale {
+				bnode.config.Items[targetID].Amount -= entry.Quantity
+				bnode.config.Balance += entry.Price
+				bnode.receiptCount++
+			} else {
+				bnode.config.Items[targetID].Amount += entry.Quantity
+			}
+
+		case LedgerPurchase, LedgerPending:
+			bnode.config.Balance -= entry.Price
+			if entry.Kind == LedgerPending {
+				pending[entry.Request] = entry
+			}
+
+		case LedgerSettled:
+			bnode.config.Balance += entry.Price
+			delete(pending, entry.Request)
+
+		default:
+			log.Printf("Node %d skipping unknown ledger entry %q", bnode.config.NodeID, entry.Kind)
+		}
+	}
+
+	// the node stopped before these sellers answered, so the payments stay
+	// withdrawn, since the sellers may have sold the items
+	for request, entry := range pending {
+		log.Printf("Node %d never settled its payment of %d to seller node %d for %s, request %s", bnode.config.NodeID, entry.Price, entry.Counterparty, entry.Item, request)
+	}
+
+	if bnode.config.Role != "seller" && bnode.config.Role != "both" {
+		return
+	}
+
+	if !bnode.sellerTargetAvailable() {
+		err := bnode.pickSellerTarget()
+		if err != nil {
+			log.Printf("Node %d could not pick a seller target after replaying ledger: %s", bnode.config.NodeID, err)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// defaultLookupCacheTTL is how long a node remembers a lookup if the node
+// config does not set a TTL.
+const defaultLookupCacheTTL = 10 * time.Second
+
+// lookupKey identifies a lookup. Lookup uuids include the buyer's node id, but
+// the buyer id is kept in the key so nodes do not rely on buyers making them
+// unique. Each walker of a random walk lookup is handled as a lookup of its
+// own.
+type lookupKey struct {
+	buyerID int
+	uuid    int64
+	walker  int
+}
+
+// seenLookup is when a node last handled a lookup, and the most hops the
+// lookup had left when the node handled it.
+type seenLookup struct {
+	at       time.Time
+	hopCount int
+}
+
+// lookupCache remembers the lookups a node has already seen, so the node can
+// drop lookups that reach it again by a different path. Entries expire after
+// the TTL. This is thread safe.
+type lookupCache struct {
+	ttl       time.Duration
+	seen      map[lookupKey]seenLookup
+	lastSweep time.Time
+
+	// suppressed is the number of repeat lookups that were dropped
+	suppressed int
+	lock       *sync.Mutex
+}
+
+// newLookupCache creates a lookup cache whose entries expire after ttl.
+func newLookupCache(ttl time.Duration) *lookupCache {
+	if ttl <= 0 {
+		ttl = defaultLookupCacheTTL
+	}
+	return &lookupCache{
+		ttl:       ttl,
+		seen:      make(map[lookupKey]seenLookup),
+		lastSweep: time.Now(),
+		lock:      &sync.Mutex{},
+	}
+}
+
+// markSeen records the lookup as seen with hopCount hops left, and returns
+// false if it was already seen with at least as many hops left and has not
+// expired yet. In that case, the lookup is counted as suppressed. A copy with
+// more hops left than any before it can reach nodes the others could not, so
+// it is not suppressed, and again is true to tell the node it has seen the
+// lookup before.
+func (cache *lookupCache) markSeen(key lookupKey, hopCount int) (ok bool, again bool) {
+	now := time.Now()
+
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+
+	// drop expired entries every ttl, so the map does not grow forever
+	if now.Sub(cache.lastSweep) > cache.ttl {
+		for seenKey, seen := range cache.seen {
+			if now.Sub(seen.at) > cache.ttl {
+				delete(cache.seen, seenKey)
+			}
+		}
+		cache.lastSweep = now
+	}
+
+	seen, found := cache.seen[key]
+	again = found && now.Sub(seen.at) <= cache.ttl
+	if again && hopCount <= seen.hopCount {
+		cache.suppressed++
+		return false, true
+	}
+
+	cache.seen[key] = seenLookup{at: now, hopCount: hopCount}
+	return true, again
+}
+
+// suppressedCount returns the number of repeat lookups that were dropped.
+func (cache *lookupCache) suppressedCount() int {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	return cache.suppressed
+}
+
+// contains returns true if the lookup was seen and has not expired yet,
+// without marking it as seen.
+func (cache *lookupCache) contains(key lookupKey) bool {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+
+	seen, ok := cache.seen[key]
+	return ok && time.Since(seen.at) <= cache.ttl
+}
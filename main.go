@@ -25,14 +25,30 @@ func main() {
 	// Load config location from commandline flag
 	var config string
 	var logFileLocation string
+	var ledgerLocation string
+	var snapshotLocation string
+	var reputationAddr string
+	var traceLocation string
 
 	// output a lot
 	var verbose bool
 	flag.StringVar(&config, "config", defaultConfig, "The config used to define node behavior (default is bazaar.yml).")
 	flag.StringVar(&logFileLocation, "logfile", defaultLogFile, "The file which logs should be written to (default is log.txt).")
+	flag.StringVar(&ledgerLocation, "ledger", "", "The file which transactions are recorded in and recovered from on restart (default is no ledger).")
+	flag.StringVar(&snapshotLocation, "snapshot", "", "The file which the node's live state is written to on shutdown, in the same format as the config (default is snapshot<nodeid>.yml).")
+	flag.StringVar(&traceLocation, "trace", "", "The file which the traces of the node's lookups are written to, if the node traces its lookups (default is no trace file).")
+	flag.StringVar(&reputationAddr, "reputation", "", "The address of a running node to print the reputation table of, instead of starting a node.")
 	flag.BoolVar(&verbose, "verbose", false, "Add this flag if you want verbose logging output.")
 	flag.Parse()
 
+	if reputationAddr != "" {
+		err = PrintReputation(reputationAddr)
+		if err != nil {
+			log.Fatalf("Error getting reputation table from %s: %s", reputationAddr, err)
+		}
+		return
+	}
+
 	// Create file to dump the node log
 	logFile, err := os.OpenFile(logFileLocation, os.O_CREATE|os.O_APPEND|os.O_RDWR, 0666)
 	if err != nil {
@@ -47,7 +63,7 @@ func main() {
 	signal.Notify(sigc, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
 
 	// Create node based on specified configuration file
-	node, err := CreateNodeFromConfigPath(config)
+	node, err := CreateNodeFromConfigPath(config, ledgerLocation)
 	if err != nil {
 		log.Fatalf("Error creating node from config at %s: %s", defaultConfig, err)
 		return
@@ -64,8 +80,28 @@ func main() {
 	perflogger := log.New(perfLogFile, "", 0)
 	node.PerfLogger = perflogger
 
+	purchaseLogFile, err := os.OpenFile(fmt.Sprint("purchaselog", node.config.NodeID, ".txt"), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0666)
+	if err != nil {
+		log.Fatal(err)
+	}
+	node.PurchaseLogger = log.New(purchaseLogFile, "", 0)
+
 	node.VerboseLogging = verbose
 
+	if traceLocation != "" {
+		traceFile, err := os.OpenFile(traceLocation, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0666)
+		if err != nil {
+			log.Fatalf("Error opening trace file: %s", err)
+		}
+		defer traceFile.Close()
+		node.TraceExport = traceFile
+	}
+
+	if snapshotLocation == "" {
+		snapshotLocation = fmt.Sprint("snapshot", node.config.NodeID, ".yml")
+	}
+	node.SnapshotPath = snapshotLocation
+
 	// Finally, listen on rpc
 	log.Printf("Listening on port %d for incoming RPC connections...", node.config.NodePort)
 	stopChan := make(chan bool)
@@ -75,6 +111,12 @@ func main() {
 	go func(nodeStop chan bool) {
 		s := <-sigc
 		log.Printf("Received signal %s, closing listener and stopping bazaar...\n", s.String())
+		err := node.SaveSnapshot(node.SnapshotPath)
+		if err != nil {
+			log.Printf("Error writing snapshot to %s: %s", node.SnapshotPath, err)
+		} else {
+			log.Printf("Wrote snapshot to %s", node.SnapshotPath)
+		}
 		<-doneChan
 		nodeStop <- true
 		close(doneChan)
@@ -88,4 +130,8 @@ func main() {
 	go server.node.init()
 	server.ListenRPC(stopChan, doneChan)
 
+	if node.ledger != nil {
+		node.ledger.Close()
+	}
+
 }
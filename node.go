@@ -3,7 +3,9 @@ package main
 import (
 	crand "crypto/rand"
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"math/rand"
@@ -20,19 +22,123 @@ import (
 
 // BazaarNode contains the state for the node.
 type BazaarNode struct {
-	config        nodeconfig.NodeConfig
-	sellerChannel chan nodeconfig.Peer
+	config nodeconfig.NodeConfig
+	state  nodeconfig.NodeState
+
+	// replies is a map from the uuid of a lookup the buyer is collecting
+	// replies for to the channel its replies are delivered to. It is
+	// protected by replyLock.
+	replies   map[int64]chan Offer
+	replyLock *sync.Mutex
 
 	// peerClients is a map from a peerID to an rpc Client that we use for
 	// communicating with that peer.
 	peerClients    map[int]*rpc.Client
 	peerClientLock *sync.Mutex
+
+	// peerHealth is a map from a peerID to the circuit breaker for that peer.
+	// It is protected by peerClientLock.
+	peerHealth map[int]*peerHealth
+
+	// peerDials is a map from a peerID to the lock held while dialing that
+	// peer, so only one call at a time dials it. It is protected by
+	// peerClientLock.
+	peerDials map[int]*sync.Mutex
+
 	VerboseLogging bool
 	PerfLogger     *log.Logger
-	lookupUUID     int
-	uuidLock       *sync.Mutex
-	perfMap        map[int][]time.Time
-	perfLock       *sync.Mutex
+
+	// PurchaseLogger is where the buyer writes the stats of its purchases
+	// with its seller selection strategy. It is nil if the node does not
+	// write them.
+	PurchaseLogger *log.Logger
+
+	lookupUUID uint32
+	uuidLock   *sync.Mutex
+	perfMap    map[int64][]time.Time
+	perfLock   *sync.Mutex
+
+	// receiptCount is the number of sales made by this node, used for
+	// generating receipt ids. It is protected by state.Mu.
+	receiptCount int
+
+	// reservations is a map from a reservation id to the units held for a
+	// buyer, and reservationCount is used for generating reservation ids. Both
+	// are protected by state.Mu.
+	reservations     map[string]*reservation
+	reservationCount int
+
+	// seenLookups holds the lookups this node has already handled, and
+	// cancelled holds the lookups their buyers have cancelled.
+	seenLookups *lookupCache
+	cancelled   *lookupCache
+
+	// catalogs holds the catalogs sellers advertised to this node, and
+	// catalogChanged has a pending signal when this seller's own catalog has
+	// to be advertised again.
+	catalogs       *catalogCache
+	catalogChanged chan struct{}
+
+	// routes and dhtRecords are this node's part of the DHT, and dhtChanged
+	// has a pending signal when this seller's items have to be registered
+	// again.
+	routes     *routingTable
+	dhtRecords *dhtStore
+	dhtChanged chan struct{}
+
+	// selector picks the seller the buyer tries first, sellers holds the
+	// latency of the sellers it bought from, and reputation holds the ratings
+	// of sellers from the buyer and its peers.
+	selector   SellerSelector
+	sellers    *sellerStats
+	reputation *reputationTable
+
+	// recentSells holds the outcomes of recent sell requests, and
+	// recentCommits the outcomes of recent commits by reservation id, so
+	// repeated requests are not sold twice. They are protected by state.Mu.
+	recentSells   *requestCache
+	recentCommits *requestCache
+
+	// walletLock protects config.Balance.
+	walletLock *sync.Mutex
+
+	// ledger is where the node records its transactions. It is nil if the
+	// node does not keep a ledger.
+	ledger *Ledger
+
+	// TraceExport is where the buyer writes the traces of its lookups, and
+	// traceLock protects it. Traces are not exported if it is nil.
+	TraceExport io.Writer
+	traceLock   *sync.Mutex
+
+	// SnapshotPath is where the node writes snapshots of its config when
+	// asked to through the snapshot RPC. Snapshots are not written to disk if
+	// it is empty.
+	SnapshotPath string
+}
+
+// Offer is a seller's reply to a lookup. It has the item the seller is
+// selling, how many units it has available, its asking price for the item,
+// when the offer expires, and how many hops away from the buyer the seller is.
+type Offer struct {
+	Seller    nodeconfig.Peer
+	Item      string
+	Available int
+	Unlimited bool
+	Price     int
+	Expires   time.Time
+	Hops      int
+}
+
+// item returns the offer as an item, so it can be checked against a lookup
+// filter.
+func (offer Offer) item() nodeconfig.ItemAmount {
+	return nodeconfig.ItemAmount{Item: offer.Item, Amount: offer.Available, Unlimited: offer.Unlimited, Price: offer.Price}
+}
+
+// Expired returns true if the offer is past its expiry time.
+func (offer Offer) Expired() bool {
+	return time.Now().After(offer.Expires)
 }
 
 // BazaarServer exposes methods for letting a node listen for RPC
@@ -66,6 +172,16 @@ func CreateNodeFromConfigFile(configFile []byte) (*BazaarNode, error) {
 		return nil, err
 	}
 
+	for _, item := range node.config.Items {
+		if item.Restock == nil {
+			continue
+		}
+		err = item.Restock.Validate()
+		if err != nil {
+			return nil, fmt.Errorf("invalid restock policy for %s: %s", item.Item, err)
+		}
+	}
+
 	// warn and return an error if the current node id is in the peer list.
 	for peer := range node.config.Peers {
 		if peer == node.config.NodeID {
@@ -79,6 +195,39 @@ func CreateNodeFromConfigFile(configFile []byte) (*BazaarNode, error) {
 		return nil, fmt.Errorf("too many peers in the peers list. There are %d, the maximum is %d", len(node.config.Peers), node.config.MaxPeers)
 	}
 
+	switch node.config.SellerMode {
+	case "", nodeconfig.SellerModeTarget, nodeconfig.SellerModeAll:
+	default:
+		return nil, fmt.Errorf("unknown seller mode %q, the seller mode must be %q or %q", node.config.SellerMode, nodeconfig.SellerModeTarget, nodeconfig.SellerModeAll)
+	}
+
+	switch node.config.ReplyPolicy {
+	case "", nodeconfig.ReplyPolicyTimeout, nodeconfig.ReplyPolicyFirst, nodeconfig.ReplyPolicyFirstN:
+	case nodeconfig.ReplyPolicyDeadline:
+		if node.config.ReplyDeadline <= 0 {
+			return nil, fmt.Errorf("the deadline reply policy needs a reply deadline greater than zero")
+		}
+	default:
+		return nil, fmt.Errorf("unknown reply policy %q, the reply policy must be %q, %q, %q or %q", node.config.ReplyPolicy, nodeconfig.ReplyPolicyTimeout, nodeconfig.ReplyPolicyFirst, nodeconfig.ReplyPolicyFirstN, nodeconfig.ReplyPolicyDeadline)
+	}
+
+	switch node.config.Search {
+	case "", nodeconfig.SearchFlood, nodeconfig.SearchRandomWalk, nodeconfig.SearchDHT:
+	default:
+		return nil, fmt.Errorf("unknown search strategy %q, the search strategy must be %q, %q or %q", node.config.Search, nodeconfig.SearchFlood, nodeconfig.SearchRandomWalk, nodeconfig.SearchDHT)
+	}
+
+	if node.config.ReputationThreshold < 0 || node.config.ReputationThreshold > 1 {
+		return nil, fmt.Errorf("the reputation threshold must be between 0 and 1, not %f", node.config.ReputationThreshold)
+	}
+
+	node.sellers = newSellerStats()
+	node.reputation = newReputationTable(node.config.ReputationHalfLife)
+	node.selector, err = newSellerSelector(node.config.SellerSelection, node.sellers, node.reputation)
+	if err != nil {
+		return nil, err
+	}
+
 	if node.config.Role == "random" {
 		randRole := rand.Intn(4)
 		switch randRole {
@@ -98,41 +247,82 @@ func CreateNodeFromConfigFile(configFile []byte) (*BazaarNode, error) {
 
 	}
 
-	if node.config.Role == "seller" || node.config.Role == "both" {
-		// NOTE: project wasnt specific on how to select seller items, so we pick at
-		// random
-		// set the sellertarget depending on the available items
-		availableItems, err := GetAvailableItems(&node)
+	// keep the seller target from the config if there is one, which is the
+	// case when loading a snapshot
+	if (node.config.Role == "seller" || node.config.Role == "both") && !node.sellerTargetAvailable() {
+		err = node.pickSellerTarget()
 		if err != nil {
-			return nil, fmt.Errorf("error getting available items when loading config: %s", err)
+			return nil, err
 		}
-
-		// if available items is empty just pick from len(items)
-		var randItemIdx int
-		if len(availableItems) == 0 {
-			log.Println("NO ITEMS AVAILABLE! Picking no items...")
-		} else {
-			// pick item at random from the list of available items
-			randItemIdx = rand.Intn(len(availableItems))
-			node.config.SellerTarget = availableItems[randItemIdx]
-		}
-
 	}
 
 	// initialize the map for peer clients
 	node.peerClients = make(map[int]*rpc.Client)
 	node.peerClientLock = &sync.Mutex{}
-	node.config.Mu = &sync.Mutex{}
+	node.peerHealth = make(map[int]*peerHealth)
+	node.peerDials = make(map[int]*sync.Mutex)
+	node.state.Mu = &sync.Mutex{}
 	node.uuidLock = &sync.Mutex{}
-	node.perfMap = make(map[int][]time.Time)
+	node.lookupUUID = rand.Uint32()
+	node.traceLock = &sync.Mutex{}
+	node.perfMap = make(map[int64][]time.Time)
 	node.perfLock = &sync.Mutex{}
+	node.reservations = make(map[string]*reservation)
+	node.receiptCount = node.config.ReceiptCount
+	node.walletLock = &sync.Mutex{}
+	node.recentSells = newRequestCache(node.config.RequestCacheSize)
+	node.recentCommits = newRequestCache(node.config.RequestCacheSize)
+	node.seenLookups = newLookupCache(node.config.LookupCacheTTL)
+	node.cancelled = newLookupCache(node.config.LookupCacheTTL)
+	node.catalogs = newCatalogCache()
+	node.catalogChanged = make(chan struct{}, 1)
+	node.routes = newRoutingTable(node.config.NodeID)
+	for peer, addr := range node.config.Peers {
+		node.routes.add(nodeconfig.Peer{PeerID: peer, Addr: addr})
+	}
+	node.dhtRecords = newDHTStore()
+	node.dhtChanged = make(chan struct{}, 1)
 
-	// initialize the seller channel, just have 100 max for now
-	node.sellerChannel = make(chan nodeconfig.Peer, 100)
+	node.replies = make(map[int64]chan Offer)
+	node.replyLock = &sync.Mutex{}
 
 	return &node, nil
 }
 
+// sellerTargetAvailable returns true if the seller target is an item the node
+// has in stock, or can restock.
+func (bnode *BazaarNode) sellerTargetAvailable() bool {
+	targetID := bnode.findItem(bnode.config.SellerTarget)
+	if targetID == -1 {
+		return false
+	}
+	return bnode.config.Items[targetID].RestocksOnDemand() || bnode.config.Items[targetID].Amount > 0
+}
+
+// pickSellerTarget sets the seller target to a random item out of the items
+// available for the node.
+func (bnode *BazaarNode) pickSellerTarget() error {
+	// NOTE: project wasnt specific on how to select seller items, so we pick at
+	// random
+	// set the sellertarget depending on the available items
+	availableItems, err := GetAvailableItems(bnode)
+	if err != nil {
+		return fmt.Errorf("error getting available items when loading config: %s", err)
+	}
+
+	// if available items is empty just pick from len(items)
+	var randItemIdx int
+	if len(availableItems) == 0 {
+		log.Println("NO ITEMS AVAILABLE! Picking no items...")
+	} else {
+		// pick item at random from the list of available items
+		randItemIdx = rand.Intn(len(availableItems))
+		bnode.config.SellerTarget = availableItems[randItemIdx]
+	}
+
+	return nil
+}
+
 // CreateRandomSellerList creates a list of random items, with amounts, for a
 // seller.
 func CreateRandomSellerList(maxItems int) []nodeconfig.ItemAmount {
@@ -163,7 +353,7 @@ func CreateRandomSellerList(maxItems int) []nodeconfig.ItemAmount {
 }
 
 // GenerateRandomItems creates a list of random items for a buyer
-func GenerateRandomItems() []string {
+func GenerateRandomItems() []nodeconfig.BuyerOption {
 
 	possibleItems := []string{"salt", "fish", "boars"}
 
@@ -172,10 +362,10 @@ func GenerateRandomItems() []string {
 
 	// generates from [1,len(possibleItems))
 	numItems := rand.Intn(len(possibleItems)) + 1
-	items := make([]string, numItems)
+	items := make([]nodeconfig.BuyerOption, numItems)
 
 	for idx := range items {
-		items[idx] = possibleItems[pickItems[idx]]
+		items[idx] = nodeconfig.BuyerOption{Item: possibleItems[pickItems[idx]]}
 	}
 
 	return items
@@ -190,7 +380,7 @@ func GetAvailableItems(bnode *BazaarNode) ([]string, error) {
 
 	var items []string
 	for _, item := range bnode.config.Items {
-		if item.Unlimited || item.Amount > 0 {
+		if item.RestocksOnDemand() || item.Amount > 0 {
 			items = append(items, item.Item)
 		}
 	}
@@ -199,14 +389,43 @@ func GetAvailableItems(bnode *BazaarNode) ([]string, error) {
 }
 
 // CreateNodeFromConfigPath loads initial node state from a config at a certain
-// path.
-func CreateNodeFromConfigPath(path string) (*BazaarNode, error) {
+// path. If ledgerPath is not empty, the ledger at that path is replayed on top
+// of the config, so the node continues with the inventory and balance it had
+// when it last stopped. All further transactions are appended to the ledger.
+// A snapshot already includes the transactions in the ledger it was taken
+// with, so it is an error to start from a snapshot with a ledger that has
+// entries.
+func CreateNodeFromConfigPath(path string, ledgerPath string) (*BazaarNode, error) {
 	configFile, err := ioutil.ReadFile(path)
 	if err != nil {
 		return nil, err
 	}
 
-	return CreateNodeFromConfigFile(configFile)
+	node, err := CreateNodeFromConfigFile(configFile)
+	if err != nil {
+		return nil, err
+	}
+
+	if ledgerPath == "" {
+		return node, nil
+	}
+
+	ledger, entries, err := OpenLedger(ledgerPath)
+	if err != nil {
+		return nil, fmt.Errorf("error opening ledger at %s: %s", ledgerPath, err)
+	}
+	if node.config.Snapshot && len(entries) > 0 {
+		ledger.Close()
+		return nil, fmt.Errorf("config at %s is a snapshot, which already includes the %d entries in the ledger at %s, start it with a new ledger", path, len(entries), ledgerPath)
+	}
+	node.ledger = ledger
+
+	if len(entries) > 0 {
+		node.replayLedger(entries)
+		log.Printf("Node %d replayed %d ledger entries from %s", node.config.NodeID, len(entries), ledgerPath)
+	}
+
+	return node, nil
 }
 
 // LookupArgs contains the RPC arguments for lookup, which is a product name,
@@ -216,7 +435,48 @@ type LookupArgs struct {
 	HopCount    int
 	BuyerID     int
 	Route       []nodeconfig.Peer
-	UUID        int
+	UUID        int64
+
+	// Filter is the constraints a seller has to meet to reply.
+	Filter nodeconfig.LookupFilter
+
+	// Started is when the buyer sent the lookup, by the buyer's clock. It is
+	// sent back with replies, so the buyer can time them.
+	Started time.Time
+
+	// Search is the search strategy the buyer started the lookup with, and
+	// Walker tells the walkers of a random walk lookup apart. Walker is zero
+	// for flooded lookups.
+	Search string
+	Walker int
+
+	// Trace is the spans the lookup has recorded so far. It is empty if the
+	// lookup is not traced.
+	Trace Trace
+
+	// Budget is how long the buyer keeps collecting replies to the lookup,
+	// from when the node it is sent to receives it. Each node takes the time
+	// it held the lookup off the budget before sending it on, so nodes do not
+	// need their clocks to agree with the buyer's. Only lookups under the
+	// deadline reply policy have a budget, and lookups without one do not
+	// expire.
+	Budget time.Duration
+
+	// deadline is when the budget runs out, by this node's clock. It is not
+	// sent with the lookup.
+	deadline time.Time
+}
+
+// received starts the lookup's budget when the node receives the lookup.
+func (args *LookupArgs) received() {
+	if args.Budget > 0 {
+		args.deadline = time.Now().Add(args.Budget)
+	}
+}
+
+// expired returns true if the lookup is past its deadline.
+func (args LookupArgs) expired() bool {
+	return !args.deadline.IsZero() && time.Now().After(args.deadline)
 }
 
 // LookupResponse is empty because no response is required for lookup.
@@ -226,22 +486,102 @@ type LookupResponse struct {
 // Lookup runs the lookup command.
 func (bnode *BazaarNode) Lookup(args LookupArgs, reply *LookupResponse) error {
 	// log.Printf("Node %d is looking for %d with lookup for %s", bnode.config.NodeID, args.BuyerID, args.ProductName)
-	return bnode.lookupProduct(args.Route, args.ProductName, args.HopCount, args.BuyerID, args.UUID)
+	args.received()
+	return bnode.lookupProduct(args)
 }
 
-// lookupProduct takes in a product name and hopcount, and runs the lookup procedure.
-func (bnode *BazaarNode) lookupProduct(route []nodeconfig.Peer, productName string, hopcount int, buyerID int, uuid int) error {
+// lookupProduct takes in the lookup arguments, and runs the lookup procedure.
+func (bnode *BazaarNode) lookupProduct(args LookupArgs) error {
+
+	productName := args.ProductName
+	hopcount := args.HopCount
+	buyerID := args.BuyerID
+	uuid := args.UUID
+
+	// Drop lookups the buyer has cancelled
+	if bnode.isCancelled(buyerID, uuid) {
+		if bnode.VerboseLogging {
+			log.Printf("Node %d is dropping cancelled lookup %d from %d for %s\n", bnode.config.NodeID, uuid, buyerID, productName)
+		}
+		bnode.countCancelled(false)
+		return nil
+	}
+
+	// Drop lookups the buyer has stopped collecting replies to
+	if args.expired() {
+		bnode.countExpiredLookup(args)
+		return nil
+	}
+
+	// Drop lookups that already reached this node by another path, so they
+	// are not flooded again and sellers do not reply twice. A copy with more
+	// hops left than before is only sent on.
+	ok, again := bnode.seenLookups.markSeen(lookupKey{buyerID: buyerID, uuid: uuid, walker: args.Walker}, hopcount)
+	if !ok {
+		suppressed := bnode.seenLookups.suppressedCount()
+		if bnode.VerboseLogging {
+			log.Printf("Node %d is dropping repeated lookup %d from %d for %s\n", bnode.config.NodeID, uuid, buyerID, productName)
+		}
+		if suppressed%100 == 0 {
+			log.Printf("Node %d has suppressed %d repeated lookups", bnode.config.NodeID, suppressed)
+		}
+		return nil
+	}
+
+	args.Trace = args.Trace.with(bnode.config.NodeID, SpanLookup)
 
 	// Add the current node to the routelist
 	portStr := net.JoinHostPort(bnode.config.NodeIP, strconv.Itoa(bnode.config.NodePort))
-	route = append(route, nodeconfig.Peer{PeerID: bnode.config.NodeID, Addr: portStr})
+	route := append(args.Route, nodeconfig.Peer{PeerID: bnode.config.NodeID, Addr: portStr})
 
 	// Reached a seller with the desired product. Send a reply.
-	if (bnode.config.Role == "seller" || bnode.config.Role == "both") && (bnode.config.SellerTarget == productName) {
+	found := false
+	if !again && (bnode.config.Role == "seller" || bnode.config.Role == "both") {
+		var item nodeconfig.ItemAmount
+		item, found = bnode.offerItem(productName)
+		if found && !args.Filter.Allows(bnode.config.NodeID, item) {
+			if bnode.VerboseLogging {
+				log.Printf("Seller node %d does not pass the filter on lookup %d from %d for %s\n", bnode.config.NodeID, uuid, buyerID, productName)
+			}
+			found = false
+		}
+		if found {
+			if bnode.VerboseLogging {
+				log.Printf("Seller has found a buyer! Replying to %d along route %v\n", buyerID, route)
+			}
+			go bnode.sendReply(ReplyArgs{
+				RouteList: route,
+				Offer: Offer{
+					Seller:    nodeconfig.Peer{PeerID: bnode.config.NodeID, Addr: net.JoinHostPort(bnode.config.NodeIP, strconv.Itoa(bnode.config.NodePort))},
+					Item:      item.Item,
+					Available: item.Amount,
+					Unlimited: item.RestocksOnDemand(),
+					Price:     item.Price,
+					Expires:   time.Now().Add(bnode.offerTTL()),
+					Hops:      len(route) - 1,
+				},
+				LookupUUID: uuid,
+				Started:    args.Started,
+				Trace:      args.Trace.with(bnode.config.NodeID, SpanOffer),
+			})
+		}
+	}
+
+	// Answer from the catalogs sellers advertised to this node. The lookup is
+	// not sent any further if the node knows of a seller.
+	cached := bnode.catalogs.find(productName, args.Filter)
+	if again && len(cached) != 0 {
+		return nil
+	}
+	for _, offer := range cached {
 		if bnode.VerboseLogging {
-			log.Printf("Seller has found a buyer! Replying to %d along route %v\n", buyerID, route)
+			log.Printf("Node %d answering lookup from %d with cached offer from seller node %d\n", bnode.config.NodeID, buyerID, offer.Seller.PeerID)
 		}
-		go bnode.reply(route, nodeconfig.Peer{PeerID: bnode.config.NodeID, Addr: net.JoinHostPort(bnode.config.NodeIP, strconv.Itoa(bnode.config.NodePort))}, uuid)
+		offer.Hops += len(route) - 1
+		go bnode.sendReply(ReplyArgs{RouteList: route, Offer: offer, LookupUUID: uuid, Started: args.Started, Trace: args.Trace.with(bnode.config.NodeID, SpanOffer)})
+	}
+	if len(cached) != 0 {
+		return nil
 	}
 
 	// log.Printf("Node %d received lookup request from %d\n", bnode.config.NodeID, buyerID)
@@ -252,6 +592,15 @@ func (bnode *BazaarNode) lookupProduct(route []nodeconfig.Peer, productName stri
 		return nil
 	}
 
+	args.Route = route
+	if args.Search == nodeconfig.SearchRandomWalk {
+		// a walker stops at the first seller it finds
+		if !found {
+			bnode.forwardWalker(args)
+		}
+		return nil
+	}
+
 	// log.Printf("Node %d flooding peers with lookup requests for %s from %d...\n", bnode.config.NodeID, productName, buyerID)
 	for peer, addr := range bnode.config.Peers {
 
@@ -269,7 +618,7 @@ func (bnode *BazaarNode) lookupProduct(route []nodeconfig.Peer, productName stri
 
 		// Flood the other peers
 		// log.Printf("Node %d is flooding peer %d for lookup\n", bnode.config.NodeID, peer)
-		go bnode.callLookupRPC(route, nodeconfig.Peer{PeerID: peer, Addr: addr}, productName, hopcount, buyerID, uuid)
+		go bnode.callLookupRPC(nodeconfig.Peer{PeerID: peer, Addr: addr}, args)
 
 	}
 
@@ -281,28 +630,70 @@ func (bnode *BazaarNode) lookupProduct(route []nodeconfig.Peer, productName stri
 // Reply relays the message back to the buyer
 func (bnode *BazaarNode) Reply(args ReplyArgs, reply *ReplyResponse) error {
 	// if len(args.RouteList) == 1 {
-	// 	log.Printf("Message at final hop: node %v with message from seller node %d", args.RouteList[len(args.RouteList)-1], args.SellerInfo.PeerID)
+	// 	log.Printf("Message at final hop: node %v with message from seller node %d", args.RouteList[len(args.RouteList)-1], args.Offer.Seller.PeerID)
 	// } else {
-	// 	log.Printf("Forward reply to node %v with message from seller node %d", args.RouteList[len(args.RouteList)-2], args.SellerInfo.PeerID)
+	// 	log.Printf("Forward reply to node %v with message from seller node %d", args.RouteList[len(args.RouteList)-2], args.Offer.Seller.PeerID)
 	// }
 
-	return bnode.reply(args.RouteList, args.SellerInfo, args.LookupUUID)
+	return bnode.reply(args)
 }
 
-// ReplyArgs contains the RPC arguments for reply, which is the backtracking list
-// and the sellerid to be returned
+// ReplyArgs contains the RPC arguments for reply, which is the backtracking list,
+// and the seller's offer to be returned.
 type ReplyArgs struct {
 	RouteList  []nodeconfig.Peer
-	SellerInfo nodeconfig.Peer
-	LookupUUID int
+	Offer      Offer
+	LookupUUID int64
+
+	// Started is when the buyer sent the lookup, and Direct is true if the
+	// seller sent the reply straight to the buyer instead of back along the
+	// route.
+	Started time.Time
+	Direct  bool
+
+	// Trace is the spans the lookup and the reply have recorded so far. It is
+	// empty if the lookup is not traced.
+	Trace Trace
 }
 
 // ReplyResponse is empty because no response is required.
 type ReplyResponse struct {
 }
 
+// sendReply sends a reply to the buyer at the start of the route. In direct
+// reply mode, the reply is sent straight to the buyer, and only sent back
+// along the route if the buyer cannot be reached directly.
+func (bnode *BazaarNode) sendReply(args ReplyArgs) {
+	if bnode.config.DirectReply && len(args.RouteList) > 1 {
+		direct := args
+		direct.RouteList = args.RouteList[:1]
+		direct.Direct = true
+
+		err := bnode.callDirectReplyRPC(args.RouteList[0], direct)
+		if err == nil {
+			return
+		}
+		log.Printf("Node %d could not reply to %d directly, replying along the route: %s", bnode.config.NodeID, args.RouteList[0].PeerID, err)
+	}
+
+	bnode.reply(args)
+}
+
 // Reply message with the peerId of the seller
-func (bnode *BazaarNode) reply(routeList []nodeconfig.Peer, sellerInfo nodeconfig.Peer, lookupUUID int) error {
+func (bnode *BazaarNode) reply(args ReplyArgs) error {
+
+	routeList := args.RouteList
+
+	// drop replies to lookups the buyer has cancelled
+	if bnode.isCancelled(routeList[0].PeerID, args.LookupUUID) {
+		if bnode.VerboseLogging {
+			log.Printf("Node %d is dropping reply from seller node %d to cancelled lookup %d\n", bnode.config.NodeID, args.Offer.Seller.PeerID, args.LookupUUID)
+		}
+		bnode.countCancelled(true)
+		return nil
+	}
+
+	args.Trace = args.Trace.with(bnode.config.NodeID, SpanReply)
 
 	// routeList: a list of ids to traverse back to the original sender in the format of
 	//         [1, 5, 2, 6], so the reverse traversal path should be 6 --> 2 --> 5 --> 1
@@ -315,17 +706,24 @@ func (bnode *BazaarNode) reply(routeList []nodeconfig.Peer, sellerInfo nodeconfi
 		// choose from.
 		// log.Printf("Node %d got a match reply from node %d ", bnode.config.NodeID, sellerInfo.PeerID)
 
-		bnode.AddLookupTime(lookupUUID)
-		// first seller
-		bnode.sellerChannel <- nodeconfig.Peer{PeerID: sellerInfo.PeerID, Addr: sellerInfo.Addr}
+		// ignore sellers with a bad reputation
+		if !bnode.trusts(args.Offer.Seller.PeerID) {
+			bnode.countIgnoredReply(args.LookupUUID, args.Offer)
+			return nil
+		}
+
+		bnode.AddLookupTime(args.LookupUUID)
+		bnode.reportReplyLatency(args)
+		bnode.exportTrace(args)
+		bnode.deliverReply(args.LookupUUID, args.Offer)
 
 	} else {
 
 		var recipient nodeconfig.Peer
-		recipient, routeList = routeList[len(routeList)-2], routeList[:len(routeList)-1]
+		recipient, args.RouteList = routeList[len(routeList)-2], routeList[:len(routeList)-1]
 
 		// log.Printf("Sending reply RPC to %s\n", recipient.Addr)
-		go bnode.callReplyRPC(recipient, routeList, sellerInfo, lookupUUID)
+		go bnode.callReplyRPC(recipient, args)
 
 	}
 
@@ -333,91 +731,459 @@ func (bnode *BazaarNode) reply(routeList []nodeconfig.Peer, sellerInfo nodeconfi
 }
 
 // TransactionArgs contains the RPC arguments for buy. CurrentTarget is the
-// what the buyer wishes to buy during this transaction
+// what the buyer wishes to buy during this transaction, Quantity is how many
+// units the buyer wants, and Payment is the most the buyer is paying for them.
+// A Quantity of zero is treated as one. RequestID should be unique for every
+// purchase the buyer makes, and be reused when the buyer retries the same
+// purchase, so that the seller does not sell twice. An empty RequestID turns
+// this off.
 type TransactionArgs struct {
 	CurrentTarget string
 	BuyerID       int
+	RequestID     string
+	Quantity      int
+	Payment       int
+}
+
+// TransactionStatus is the outcome of a transaction, as reported by the
+// seller.
+type TransactionStatus int
+
+const (
+	// StatusSold means the item was in stock and was sold to the buyer.
+	StatusSold TransactionStatus = iota
+
+	// StatusSoldOut means the seller stocks the item but has none left.
+	StatusSoldOut
+
+	// StatusUnknownItem means the seller does not stock the item at all.
+	StatusUnknownItem
+
+	// StatusRestocked means the seller was out of an unlimited item, restocked
+	// it, and then sold it to the buyer.
+	StatusRestocked
+
+	// StatusReserved means the item is being held for the buyer until the
+	// buyer commits or aborts, or the reservation lease runs out.
+	StatusReserved
+
+	// StatusNoReservation means the reservation does not exist, either
+	// because it expired, was aborted, or was already committed.
+	StatusNoReservation
+
+	// StatusInsufficientFunds means the buyer's payment does not cover the
+	// seller's price for the item.
+	StatusInsufficientFunds
+)
+
+// String returns a human readable name for the transaction status.
+func (status TransactionStatus) String() string {
+	switch status {
+	case StatusSold:
+		return "sold"
+	case StatusSoldOut:
+		return "sold out"
+	case StatusUnknownItem:
+		return "unknown item"
+	case StatusRestocked:
+		return "restocked"
+	case StatusReserved:
+		return "reserved"
+	case StatusNoReservation:
+		return "no reservation"
+	case StatusInsufficientFunds:
+		return "insufficient funds"
+	default:
+		return fmt.Sprintf("unknown status %d", int(status))
+	}
+}
+
+// Succeeded returns true if the buyer received the item in the transaction.
+func (status TransactionStatus) Succeeded() bool {
+	return status == StatusSold || status == StatusRestocked
 }
 
-// TransactionResponse is empty for now
+// TransactionResponse contains the outcome of a transaction. Quantity is the
+// number of units delivered to the buyer, which is less than the number
+// requested if the seller could only partially fill the order. Remaining is
+// the stock the seller has left of the item after the transaction, Price is
+// what the buyer was charged, and ReceiptID identifies the sale. The ReceiptID
+// is empty if nothing was sold.
 type TransactionResponse struct {
+	Status    TransactionStatus
+	Quantity  int
+	Remaining int
+	Price     int
+	ReceiptID string
 }
 
-// Buy item directly from the seller with RCP call
-func (bnode *BazaarNode) buy(seller nodeconfig.Peer) error {
+// buy tries to buy quantity units of the target item from the sellers in the
+// list, starting at the seller at index start. Whenever a seller fails or only
+// partially fills the order, the buyer moves on to the next seller for the
+// rest. It stops once the whole quantity has been bought.
+func (bnode *BazaarNode) buy(sellers []Offer, start int, target string, quantity int) error {
+
+	remaining := quantity
+	for i := 0; i < len(sellers) && remaining > 0; i++ {
+		quote := sellers[(start+i)%len(sellers)]
+		seller := quote.Seller
+
+		// log.Printf("Node %d buying from seller node %d", bnode.config.NodeID, seller.PeerID)
+		// the seller is only rated on the units the buyer paid for
+		var res TransactionResponse
+		var ordered int
+		var err error
+		if bnode.config.Reserve {
+			res, ordered, err = bnode.reserveAndCommit(seller, target, remaining)
+			if err == nil {
+				err = statusError(res.Status)
+			}
+		} else {
+			res, ordered, err = bnode.payAndSell(seller, target, remaining, quote.Price)
+		}
+		bnode.rateSeller(seller.PeerID, ordered, res, err)
+		if errors.Is(err, ErrOutcomeUnknown) {
+			// the buyer may have bought the items, so buying them again from
+			// another seller could buy them twice
+			return fmt.Errorf("node %d does not know if it bought %s from seller node %d: %w", bnode.config.NodeID, target, seller.PeerID, err)
+		}
+		if err != nil || !res.Status.Succeeded() {
+			log.Printf("Node %d could not buy %s from seller node %d: %s", bnode.config.NodeID, target, seller.PeerID, err)
+			continue
+		}
+
+		remaining -= res.Quantity
+		bnode.record(LedgerEntry{Kind: LedgerPurchase, Item: target, Quantity: res.Quantity, Price: res.Price, Counterparty: seller.PeerID, ReceiptID: res.ReceiptID})
+		log.Printf("Node %d bought %d %s from seller node %d for %d, receipt %s, balance remaining %d", bnode.config.NodeID, res.Quantity, target, seller.PeerID, res.Price, res.ReceiptID, bnode.balance())
+	}
 
-	// log.Printf("Node %d buying from seller node %d", bnode.config.NodeID, seller.PeerID)
-	go bnode.callSellRPC(seller)
+	if remaining > 0 {
+		return fmt.Errorf("sellers could only sell %d out of %d %s to node %d", quantity-remaining, quantity, target, bnode.config.NodeID)
+	}
 
 	return nil
 
 }
 
-// Sell runs the sell command
+// recordSellerLatency records how long the seller took to answer a sell or
+// commit call sent at the given time. Calls the seller never answered, such as
+// ones to a peer the buyer is backing off from, are not recorded, since they
+// would make an unreachable seller look like the fastest one.
+func (bnode *BazaarNode) recordSellerLatency(seller nodeconfig.Peer, sent time.Time, err error) {
+	if answered(err) {
+		bnode.sellers.record(seller.PeerID, time.Since(sent))
+	}
+}
+
+// holdPayment records a payment to the seller whose outcome is unknown as
+// pending, so a node restarted from its ledger keeps it withdrawn, and keeps
+// asking the seller for the outcome in the background. The call must repeat
+// the original request, which the seller answers with its original outcome.
+func (bnode *BazaarNode) holdPayment(seller nodeconfig.Peer, pending LedgerEntry, call func() (TransactionResponse, error)) {
+	pending.Kind = LedgerPending
+	bnode.record(pending)
+
+	go func() {
+		for round := 0; round < settleRounds; round++ {
+			time.Sleep(maxBackoff)
+			res, err := call()
+			if answered(err) {
+				bnode.settlePayment(pending, res, err)
+				return
+			}
+		}
+		log.Printf("Node %d gave up on settling its payment of %d to seller node %d for %s, request %s", bnode.config.NodeID, pending.Price, seller.PeerID, pending.Item, pending.Request)
+	}()
+}
+
+// settlePayment settles a pending payment once the seller has answered its
+// request. What the seller did not charge is refunded, and the items it sold,
+// if any, are recorded as a purchase.
+func (bnode *BazaarNode) settlePayment(pending LedgerEntry, res TransactionResponse, err error) {
+	sold := err == nil && res.Status.Succeeded()
+	if sold {
+		bnode.record(LedgerEntry{Kind: LedgerPurchase, Item: pending.Item, Quantity: res.Quantity, Price: res.Price, Counterparty: pending.Counterparty, ReceiptID: res.ReceiptID})
+	}
+	bnode.record(LedgerEntry{Kind: LedgerSettled, Item: pending.Item, Price: pending.Price, Counterparty: pending.Counterparty, Request: pending.Request})
+
+	refund := pending.Price
+	if sold {
+		refund -= res.Price
+	}
+	bnode.deposit(refund)
+	log.Printf("Node %d settled its payment to seller node %d for %s, request %s: bought %d for %d, balance remaining %d", bnode.config.NodeID, pending.Counterparty, pending.Item, pending.Request, res.Quantity, pending.Price-refund, bnode.balance())
+}
+
+// payAndSell withdraws the quoted unit price for quantity units from the
+// buyer's balance, or as much of it as the buyer has, and pays it to the
+// seller for the target item. The seller only sells as many units as the
+// payment covers. Anything the seller does not charge, for example because it
+// could only partially fill the order, is refunded. It also returns the
+// number of units the buyer paid for. If the seller never answers, the payment
+// is held as pending, since the seller may have sold the items, and
+// ErrOutcomeUnknown is returned.
+func (bnode *BazaarNode) payAndSell(seller nodeconfig.Peer, target string, quantity int, price int) (TransactionResponse, int, error) {
+
+	payment := bnode.withdrawUpTo(price * quantity)
+	if payment < price {
+		bnode.deposit(payment)
+		return TransactionResponse{Status: StatusInsufficientFunds}, 0, fmt.Errorf("%w: node %d cannot pay %d", ErrInsufficientFunds, bnode.config.NodeID, price)
+	}
+	if price > 0 {
+		quantity = payment / price
+	}
+
+	// the request id is the same for every attempt, so the seller sells once
+	requestID := bnode.newRequestID()
+	var res TransactionResponse
+	sent := time.Now()
+	err := bnode.settleOutcome(seller, func() error {
+		var err error
+		res, err = bnode.callSellRPC(seller, requestID, target, quantity, payment)
+		return err
+	})
+	bnode.recordSellerLatency(seller, sent, err)
+	if errors.Is(err, ErrOutcomeUnknown) {
+		pending := LedgerEntry{Item: target, Quantity: quantity, Price: payment, Counterparty: seller.PeerID, Request: requestID}
+		bnode.holdPayment(seller, pending, func() (TransactionResponse, error) {
+			return bnode.callSellRPC(seller, requestID, target, quantity, payment)
+		})
+		return TransactionResponse{}, quantity, err
+	}
+	if err != nil {
+		bnode.deposit(payment)
+		return TransactionResponse{}, quantity, err
+	}
+	bnode.deposit(payment - res.Price)
+
+	return res, quantity, nil
+}
+
+// buyQuantity returns the number of units the buyer buys of each item.
+func (bnode *BazaarNode) buyQuantity() int {
+	if bnode.config.BuyQuantity < 1 {
+		return 1
+	}
+	return bnode.config.BuyQuantity
+}
+
+// Sell runs the sell command. If nothing could be sold, it returns
+// ErrUnknownItem, ErrNotSeller, ErrOutOfStock, ErrInvalidBuyer, or
+// ErrInsufficientFunds. The reply still holds the status of the transaction,
+// but it is only sent to remote callers if there is no error.
 func (bnode *BazaarNode) Sell(args TransactionArgs, reply *TransactionResponse) error {
 	if bnode.VerboseLogging {
 		log.Printf("Seller node %d selling item %s", bnode.config.NodeID, args.CurrentTarget)
 	}
-	return bnode.sell(args.CurrentTarget, args.BuyerID)
+
+	res, err := bnode.sell(args.CurrentTarget, args.BuyerID, args.RequestID, args.Quantity, args.Payment)
+	*reply = res
+	return err
 }
 
-func (bnode *BazaarNode) sell(target string, buyerID int) error {
+// sell sells the target item to the buyer. If the request id is not empty and
+// the seller has already handled a request with the same id from the buyer,
+// the outcome of that request is returned and nothing is sold again.
+func (bnode *BazaarNode) sell(target string, buyerID int, requestID string, quantity int, payment int) (TransactionResponse, error) {
+
+	if bnode.config.Role != "seller" && bnode.config.Role != "both" {
+		return TransactionResponse{}, fmt.Errorf("%w: node %d is a %s", ErrNotSeller, bnode.config.NodeID, bnode.config.Role)
+	}
+	if buyerID < 0 {
+		return TransactionResponse{}, fmt.Errorf("%w: buyer id %d is negative", ErrInvalidBuyer, buyerID)
+	}
+
+	bnode.state.Mu.Lock()
+	defer bnode.state.Mu.Unlock()
+
+	key := requestKey{buyerID: buyerID, requestID: requestID}
+	res, ok := bnode.recentSells.get(key)
+	if requestID != "" && ok {
+		log.Printf("Seller node %d answering repeated request %s from %d with its original outcome", bnode.config.NodeID, requestID, buyerID)
+	} else {
+		res = bnode.completeSale(target, buyerID, quantity, payment)
+		if requestID != "" {
+			bnode.recentSells.put(key, res)
+		}
+	}
+
+	err := statusError(res.Status)
+	if err != nil {
+		return res, fmt.Errorf("%w: node %d cannot sell %s to %d", err, bnode.config.NodeID, target, buyerID)
+	}
+
+	return res, nil
+
+}
+
+// completeSale sells up to quantity units of the target item to the buyer,
+// charging at most the payment. The caller must hold the node lock.
+func (bnode *BazaarNode) completeSale(target string, buyerID int, quantity int, payment int) TransactionResponse {
+
+	if quantity < 1 {
+		quantity = 1
+	}
 
 	// target: the requested item by the buyer
 	// Extract the itemID for the requested item
-	var targetID int
-	for itemID := range bnode.config.Items {
-		if bnode.config.Items[itemID].Item == target {
-			targetID = itemID
+	targetID := bnode.findItem(target)
+	if targetID == -1 {
+		if bnode.VerboseLogging {
+			log.Printf("Seller node %d does not stock %s", bnode.config.NodeID, target)
 		}
+		return TransactionResponse{Status: StatusUnknownItem}
 	}
 
-	// Complete the transaction
-	bnode.config.Mu.Lock()
-	if bnode.config.Items[targetID].Amount > 0 {
+	// only sell as many units as the payment covers, and reject the purchase
+	// before touching the stock if the buyer cannot pay for any
+	price := bnode.config.Items[targetID].Price
+	if price > 0 && payment/price < quantity {
+		quantity = payment / price
+	}
+	if quantity == 0 {
+		return TransactionResponse{Status: StatusInsufficientFunds}
+	}
 
-		bnode.config.Items[targetID].Amount--
-		log.Printf("💰💰💰 Node %d sold %s to %d, amount remaining %d 💰💰💰", bnode.config.NodeID, target, buyerID, bnode.config.Items[targetID].Amount)
+	filled, status := bnode.takeStock(targetID, quantity)
+	if !status.Succeeded() {
+		return TransactionResponse{Status: status}
+	}
+	bnode.deposit(price * filled)
 
-	} else {
+	log.Printf("💰💰💰 Node %d sold %d %s to %d for %d, amount remaining %d 💰💰💰", bnode.config.NodeID, filled, target, buyerID, price*filled, bnode.config.Items[targetID].Amount)
 
-		// If the item is defined to be unlimited in the YAML file restock the item and purchase again
-		if bnode.config.Items[targetID].Unlimited {
+	res := TransactionResponse{
+		Status:    status,
+		Quantity:  filled,
+		Remaining: bnode.config.Items[targetID].Amount,
+		Price:     price * filled,
+		ReceiptID: bnode.nextReceiptID(buyerID),
+	}
+	bnode.record(LedgerEntry{Kind: LedgerSale, Item: target, Quantity: filled, Price: res.Price, Counterparty: buyerID, ReceiptID: res.ReceiptID})
 
-			bnode.config.Items[targetID].Amount += 10
-			if bnode.VerboseLogging {
-				log.Printf("Seller node %d restocked %s", bnode.config.NodeID, bnode.config.Items[targetID].Item)
-			}
+	return res
 
-			bnode.config.Items[targetID].Amount--
-			log.Printf("💰💰💰 Node %d sold %s to %d, amount remaining %d 💰💰💰", bnode.config.NodeID, target, buyerID, bnode.config.Items[targetID].Amount)
+}
 
-		} else {
+// offerItem returns the seller's stock of the product, and whether the seller
+// should reply to a lookup for it. In the "target" seller mode, the seller
+// only offers its seller target. In the "all" seller mode, it offers any item
+// it has in stock or can restock.
+func (bnode *BazaarNode) offerItem(productName string) (nodeconfig.ItemAmount, bool) {
 
-			// Item sold out. Pick another item randomly to sell
-			var commodity []string
-			for itemID := range bnode.config.Items {
-				if bnode.config.Items[itemID].Amount > 0 {
-					commodity = append(commodity, bnode.config.Items[itemID].Item)
-				}
-			}
+	bnode.state.Mu.Lock()
+	defer bnode.state.Mu.Unlock()
 
-			// only select from random if there are things to select
-			if len(commodity) > 0 {
-				bnode.config.SellerTarget = commodity[rand.Intn(len(commodity))]
-				log.Printf("Seller node %d now selling %s", bnode.config.NodeID, bnode.config.SellerTarget)
-			} else {
-				log.Printf("Seller node %d is out of items!\n", bnode.config.NodeID)
-			}
+	targetID := bnode.findItem(productName)
+	if targetID == -1 {
+		return nodeconfig.ItemAmount{}, false
+	}
+	item := bnode.config.Items[targetID]
+
+	return item, bnode.offersItem(item)
+}
+
+// offersItem returns true if the seller replies to lookups for the item. The
+// caller must hold the node lock.
+func (bnode *BazaarNode) offersItem(item nodeconfig.ItemAmount) bool {
+	switch bnode.config.SellerMode {
+	case nodeconfig.SellerModeAll:
+		return item.RestocksOnDemand() || item.Amount > 0
+	default:
+		return bnode.config.SellerTarget == item.Item
+	}
+}
+
+// findItem returns the index of the target item in the seller's items, or -1
+// if the seller does not stock the item.
+func (bnode *BazaarNode) findItem(target string) int {
+	targetID := -1
+	for itemID := range bnode.config.Items {
+		if bnode.config.Items[itemID].Item == target {
+			targetID = itemID
+		}
+	}
+	return targetID
+}
+
+// takeStock takes up to quantity units of the item at index targetID out of
+// the seller's stock, and returns how many units it took. Items are filled as
+// far as the stock goes, except for items with a batch restock policy, which
+// are restocked until the whole quantity can be filled or the restock cap is
+// reached. The status is StatusSold if the units were in stock,
+// StatusRestocked if the item had to be restocked first, and StatusSoldOut if
+// there was nothing to take, in which case the seller picks another item to
+// sell. The caller must hold the node lock.
+func (bnode *BazaarNode) takeStock(targetID int, quantity int) (int, TransactionStatus) {
+
+	status := StatusSold
+
+	// If the item is unlimited in the YAML file, or has a batch restock
+	// policy, restock the item until there is enough to purchase
+	policy := bnode.config.Items[targetID].RestockPolicy()
+	for policy.Mode == nodeconfig.RestockBatch && bnode.config.Items[targetID].Amount < quantity {
+		restock := policy.RestockAmount(bnode.config.Items[targetID].Amount)
+		if restock == 0 {
+			break
 		}
 
+		bnode.restock(targetID, restock)
+		status = StatusRestocked
 	}
-	bnode.config.Mu.Unlock()
 
-	return nil
+	filled := quantity
+	if bnode.config.Items[targetID].Amount < filled {
+		filled = bnode.config.Items[targetID].Amount
+	}
+	if filled > 0 {
+		bnode.config.Items[targetID].Amount -= filled
+		if bnode.config.Items[targetID].Amount == 0 && policy.Mode != nodeconfig.RestockBatch {
+			bnode.invalidateCatalog()
+		}
+		return filled, status
+	}
+
+	// Item sold out. Pick another item randomly to sell
+	var commodity []string
+	for itemID := range bnode.config.Items {
+		if bnode.config.Items[itemID].Amount > 0 {
+			commodity = append(commodity, bnode.config.Items[itemID].Item)
+		}
+	}
+
+	// only select from random if there are things to select
+	if len(commodity) > 0 {
+		bnode.config.SellerTarget = commodity[rand.Intn(len(commodity))]
+		log.Printf("Seller node %d now selling %s", bnode.config.NodeID, bnode.config.SellerTarget)
+	} else {
+		log.Printf("Seller node %d is out of items!\n", bnode.config.NodeID)
+	}
+	bnode.invalidateCatalog()
+
+	return 0, StatusSoldOut
 
 }
 
+// newRequestID generates a request id for a purchase by this node. Request ids
+// contain random bytes, so they stay unique when the node restarts.
+func (bnode *BazaarNode) newRequestID() string {
+	var random [8]byte
+	_, err := crand.Read(random[:])
+	if err != nil {
+		// math rand is good enough to tell requests apart
+		binary.BigEndian.PutUint64(random[:], rand.Uint64())
+	}
+	return fmt.Sprintf("%d-%x", bnode.config.NodeID, random)
+}
+
+// nextReceiptID generates a receipt id for a sale to the given buyer. Receipt
+// ids are unique per seller, since they contain the seller id and a counter.
+// The caller must hold the node lock.
+func (bnode *BazaarNode) nextReceiptID(buyerID int) string {
+	bnode.receiptCount++
+	return fmt.Sprintf("%d-%d-%d", bnode.config.NodeID, buyerID, bnode.receiptCount)
+}
+
 // ListenRPC listens on RPC for all methods on the desired listener. To stop
 // listening, one passes a bool to the stopChannel or closes stopChannel. This
 // method should be run in a goroutine. The listener passed will be closed if
@@ -468,11 +1234,27 @@ func unique(intSlice []int) []int {
 
 // init is the entrance point for all nodes
 func (bnode *BazaarNode) init() {
+	if bnode.config.Role == "seller" || bnode.config.Role == "both" {
+		bnode.startRestocking()
+		if bnode.config.AdvertiseInterval > 0 {
+			go bnode.advertiseLoop()
+		}
+	}
+	if bnode.config.Search == nodeconfig.SearchDHT {
+		go bnode.dhtLoop()
+	}
+	if bnode.config.ReputationGossip > 0 {
+		go bnode.reputationLoop()
+	}
 	if bnode.config.Role == "buyer" || bnode.config.Role == "both" {
 		bnode.buyerLoop()
 	}
 }
 
+// lookupInterval is the shortest time between the start of two of the buyer's
+// lookups.
+const lookupInterval = 200 * time.Millisecond
+
 // buyerLoop is the lookup/buy loop for the buyer
 func (bnode *BazaarNode) buyerLoop() {
 	// wait before starting the buyer loop
@@ -481,35 +1263,23 @@ func (bnode *BazaarNode) buyerLoop() {
 	for {
 
 		// Generate a buy request
+		var filter nodeconfig.LookupFilter
 		if len(bnode.config.BuyerOptionList) != 0 {
-			bnode.config.BuyerTarget = bnode.config.BuyerOptionList[rand.Intn(len(bnode.config.BuyerOptionList))]
+			option := bnode.config.BuyerOptionList[rand.Intn(len(bnode.config.BuyerOptionList))]
+			bnode.state.BuyerTarget = option.Item
+			filter = option.LookupFilter
 			if bnode.VerboseLogging {
-				log.Printf("Node %d plans to buy %s", bnode.config.NodeID, bnode.config.BuyerTarget)
+				log.Printf("Node %d plans to buy %s", bnode.config.NodeID, bnode.state.BuyerTarget)
 			}
 
 		}
 
 		// Lookup request to neighbours
-		// portStr := net.JoinHostPort(bnode.config.NodeIP, strconv.Itoa(bnode.config.NodePort))
-		lookupUUID := bnode.GetLookupUUID()
-		args := LookupArgs{
-			ProductName: bnode.config.BuyerTarget,
-			HopCount:    bnode.config.MaxHops,
-			BuyerID:     bnode.config.NodeID,
-			Route:       []nodeconfig.Peer{},
-			UUID:        lookupUUID,
-		}
-
-		var rpcResponse LookupResponse
 		startTime := time.Now()
-		go bnode.Lookup(args, &rpcResponse)
-		// log.Printf("Waiting to retrieve sellers...")
-
-		// Buy from the list of available sellers
-		time.Sleep(200 * time.Millisecond)
+		lookupUUID, _, tempSellerList := bnode.search(bnode.state.BuyerTarget, filter)
 
-		// NOTE: we are assuming here that this is the corresponding reply for
-		// the previously issued lookup request
+		// replies are collected per lookup, so the earliest reply to this
+		// lookup gives its latency
 		endTime, err := bnode.GetEarliestLookup(lookupUUID)
 		if err == nil {
 			bnode.reportLookupLatency(startTime, endTime)
@@ -517,68 +1287,130 @@ func (bnode *BazaarNode) buyerLoop() {
 			// log.Println("Not reporting latency, no data")
 		}
 
-		var tempSellerList []nodeconfig.Peer
-		for i := 0; i < len(bnode.sellerChannel); i++ {
-			tempSellerList = append(tempSellerList, <-bnode.sellerChannel)
-		}
+		bnode.reportSearch(len(tempSellerList) != 0)
 
-		// dedupe seller list
-		var sellerList []nodeconfig.Peer
-		peerMap := make(map[int]nodeconfig.Peer)
-		for _, peer := range tempSellerList {
-			_, ok := peerMap[peer.PeerID]
+		// dedupe seller list, and drop the offers that expired or that we
+		// cannot afford
+		var sellerList []Offer
+		peerMap := make(map[int]Offer)
+		balance := bnode.balance()
+		for _, quote := range tempSellerList {
+			_, ok := peerMap[quote.Seller.PeerID]
 			if !ok {
-				peerMap[peer.PeerID] = peer
-				sellerList = append(sellerList, peer)
+				peerMap[quote.Seller.PeerID] = quote
+				if quote.Expired() {
+					if bnode.VerboseLogging {
+						log.Printf("Node %d dropping expired offer for %s from seller node %d", bnode.config.NodeID, bnode.state.BuyerTarget, quote.Seller.PeerID)
+					}
+					continue
+				}
+				if quote.Price > balance {
+					if bnode.VerboseLogging {
+						log.Printf("Node %d cannot afford %s from seller node %d for %d", bnode.config.NodeID, bnode.state.BuyerTarget, quote.Seller.PeerID, quote.Price)
+					}
+					continue
+				}
+				sellerList = append(sellerList, quote)
 			}
 		}
 
 		if len(sellerList) != 0 {
-			replyString := fmt.Sprintf("Node %d Received replies from ", bnode.config.NodeID)
-			for i, seller := range sellerList {
+			replyString := fmt.Sprintf("Node %d Received replies for lookup %d from ", bnode.config.NodeID, lookupUUID)
+			for i, quote := range sellerList {
+				available := strconv.Itoa(quote.Available)
+				if quote.Unlimited {
+					available = "unlimited"
+				}
+				offer := fmt.Sprintf("%d (price %d, %s available, %d hops)", quote.Seller.PeerID, quote.Price, available, quote.Hops)
 				if i == 0 {
-					replyString += strconv.Itoa(seller.PeerID)
+					replyString += offer
 				} else if i == len(sellerList)-1 {
-					replyString += ", and " + strconv.Itoa(seller.PeerID)
+					replyString += ", and " + offer
 				} else {
-					replyString += ", " + strconv.Itoa(seller.PeerID)
+					replyString += ", " + offer
 				}
 			}
 			log.Println(replyString)
 
-			randomSeller := sellerList[rand.Intn(len(sellerList))]
-			go bnode.buy(randomSeller)
-			log.Printf("Node %d is trying to buy %s from seller node %d", bnode.config.NodeID, bnode.config.BuyerTarget, randomSeller.PeerID)
+			// start at the seller picked by the buyer's seller selection, and
+			// move on to the next seller in the list if the purchase fails
+			start := bnode.selector.Select(sellerList)
+			log.Printf("Node %d is trying to buy %s from seller node %d, picked by %s seller selection", bnode.config.NodeID, bnode.state.BuyerTarget, sellerList[start].Seller.PeerID, bnode.sellerSelection())
+
+			// the purchase finishes before the next lookup, so purchases
+			// cannot pile up when sellers are slow
+			purchaseStart := time.Now()
+			err := bnode.buy(sellerList, start, bnode.state.BuyerTarget, bnode.buyQuantity())
+			bnode.reportPurchase(sellerList[start], time.Since(purchaseStart), err == nil)
+			if err != nil {
+				log.Printf("Node %d failed to buy: %s", bnode.config.NodeID, err)
+			}
 		}
 
+		// reply policies that stop at the first reply can make a lookup
+		// quick, so the buyer still waits between lookups
+		if wait := lookupInterval - time.Since(startTime); wait > 0 {
+			time.Sleep(wait)
+		}
 	}
 
 }
 
+// reportReplyLatency records how long a reply took to reach the buyer, by the
+// path it took, and logs the average latency of each path every 50 replies.
+// Replies from the buyer itself are not counted.
+func (bnode *BazaarNode) reportReplyLatency(args ReplyArgs) {
+	if args.Started.IsZero() || args.Offer.Hops == 0 {
+		return
+	}
+	duration := time.Since(args.Started).Seconds()
+
+	bnode.perfLock.Lock()
+	defer bnode.perfLock.Unlock()
+
+	if args.Direct {
+		bnode.state.LatencyDirect += duration
+		bnode.state.RequestCountDirect++
+		if bnode.state.RequestCountDirect%50 == 0 {
+			log.Printf("👽👽👽 Average direct reply latency of node %d: %f 👽👽👽", bnode.config.NodeID, bnode.state.LatencyDirect/float64(bnode.state.RequestCountDirect))
+		}
+	} else {
+		bnode.state.LatencyReverse += duration
+		bnode.state.RequestCountReverse++
+		if bnode.state.RequestCountReverse%50 == 0 {
+			log.Printf("👽👽👽 Average reverse path reply latency of node %d: %f 👽👽👽", bnode.config.NodeID, bnode.state.LatencyReverse/float64(bnode.state.RequestCountReverse))
+		}
+	}
+}
+
 // reportLatency logs the average latency of RPC calls every 50 invocations
 func (bnode *BazaarNode) reportRPCLatency(start time.Time, end time.Time, peer string) {
 
 	peerIP := strings.Split(peer, ":")[0]
 
+	// calls to different peers finish at the same time
+	bnode.perfLock.Lock()
+	defer bnode.perfLock.Unlock()
+
 	if peerIP == bnode.config.NodeIP {
 
 		durationFloat64 := end.Sub(start).Seconds()
-		bnode.config.LatencyLocal += durationFloat64
-		bnode.config.RequestCountLocal += 1
+		bnode.state.LatencyLocal += durationFloat64
+		bnode.state.RequestCountLocal += 1
 
-		if bnode.config.RequestCountLocal%500 == 0 {
-			averageLatency := bnode.config.LatencyLocal / float64(bnode.config.RequestCountLocal)
+		if bnode.state.RequestCountLocal%500 == 0 {
+			averageLatency := bnode.state.LatencyLocal / float64(bnode.state.RequestCountLocal)
 			log.Printf("👽👽👽 Average Local RPC Latency of peer %d： %f 👽👽👽", bnode.config.NodeID, averageLatency)
 		}
 
 	} else {
 
 		durationFloat64 := end.Sub(start).Seconds()
-		bnode.config.LatencyRemote += durationFloat64
-		bnode.config.RequestCountRemote += 1
+		bnode.state.LatencyRemote += durationFloat64
+		bnode.state.RequestCountRemote += 1
 
-		if bnode.config.RequestCountRemote%500 == 0 {
-			averageLatency := bnode.config.LatencyRemote / float64(bnode.config.RequestCountRemote)
+		if bnode.state.RequestCountRemote%500 == 0 {
+			averageLatency := bnode.state.LatencyRemote / float64(bnode.state.RequestCountRemote)
 			log.Printf("👽👽👽 Average Remote RPC Latency of peer %d： %f 👽👽👽", bnode.config.NodeID, averageLatency)
 		}
 
@@ -590,10 +1422,10 @@ func (bnode *BazaarNode) reportRPCLatency(start time.Time, end time.Time, peer s
 func (bnode *BazaarNode) reportLookupLatency(start time.Time, end time.Time) {
 
 	durationFloat64 := end.Sub(start).Seconds()
-	bnode.config.LatencyLookup += durationFloat64
-	bnode.config.RequestCountLookup += 1
+	bnode.state.LatencyLookup += durationFloat64
+	bnode.state.RequestCountLookup += 1
 
-	averageLatency := bnode.config.LatencyLookup / float64(bnode.config.RequestCountLookup)
+	averageLatency := bnode.state.LatencyLookup / float64(bnode.state.RequestCountLookup)
 	bnode.PerfLogger.Printf("%f", averageLatency)
 
 }
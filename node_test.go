@@ -1,9 +1,23 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
 	"net"
+	"net/rpc"
+	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/rjected/bazaar/nodeconfig"
 )
@@ -128,8 +142,8 @@ func TestReplySimpleRPC(t *testing.T) {
 	// have called the lookup method.
 	portStr := net.JoinHostPort(testNodeB.config.NodeIP, strconv.Itoa(testNodeB.config.NodePort))
 	args := ReplyArgs{
-		RouteList:  []nodeconfig.Peer{{PeerID: testNodeB.config.NodeID, Addr: portStr}},
-		SellerInfo: nodeconfig.Peer{PeerID: testNodeB.config.NodeID, Addr: net.JoinHostPort(testNodeB.config.NodeIP, strconv.Itoa(testNodeB.config.NodePort))},
+		RouteList: []nodeconfig.Peer{{PeerID: testNodeB.config.NodeID, Addr: portStr}},
+		Offer:     Offer{Seller: nodeconfig.Peer{PeerID: testNodeB.config.NodeID, Addr: net.JoinHostPort(testNodeB.config.NodeIP, strconv.Itoa(testNodeB.config.NodePort))}},
 	}
 
 	var rpcResponse ReplyResponse
@@ -153,6 +167,9 @@ func TestBuySimple(t *testing.T) {
 		return
 	}
 
+	// only sellers can sell
+	testnode.config.Role = "seller"
+
 	transactionArgs := TransactionArgs{CurrentTarget: "salt", BuyerID: testnode.config.NodeID}
 	var transactionResponse TransactionResponse
 	err = testnode.Sell(transactionArgs, &transactionResponse)
@@ -160,6 +177,1665 @@ func TestBuySimple(t *testing.T) {
 		t.Fatalf("error selling: %s", err)
 		return
 	}
+
+	if transactionResponse.Status != StatusSold {
+		t.Fatalf("expected status %s, got %s", StatusSold, transactionResponse.Status)
+	}
+	if transactionResponse.Quantity != 1 || transactionResponse.Remaining != 9 {
+		t.Fatalf("expected 1 unit sold with 9 remaining, got %d sold with %d remaining", transactionResponse.Quantity, transactionResponse.Remaining)
+	}
+	if transactionResponse.ReceiptID == "" {
+		t.Fatalf("expected a receipt id for a successful sale")
+	}
+}
+
+// TestSellOutcomes tests that the transaction response reports sold out,
+// restocked, and unknown items.
+func TestSellOutcomes(t *testing.T) {
+
+	// create testnode from test config
+	testnode, err := CreateNodeFromConfigFile([]byte(testingConfig))
+	if err != nil {
+		t.Fatalf("Error configuring node for test rpc call: %s", err)
+		return
+	}
+
+	// only sellers can sell
+	testnode.config.Role = "seller"
+
+	cases := []struct {
+		item   string
+		status TransactionStatus
+		err    error
+	}{
+		// there is one fish, so the first sale goes through and the second
+		// sells out
+		{"fish", StatusSold, nil},
+		{"fish", StatusSoldOut, ErrOutOfStock},
+
+		// boars are unlimited with no stock, so they must be restocked
+		{"boars", StatusRestocked, nil},
+		{"boars", StatusSold, nil},
+
+		// nobody sells pigs
+		{"pigs", StatusUnknownItem, ErrUnknownItem},
+	}
+
+	for _, c := range cases {
+		var res TransactionResponse
+		err = testnode.Sell(TransactionArgs{CurrentTarget: c.item, BuyerID: 0}, &res)
+		if !errors.Is(err, c.err) {
+			t.Fatalf("expected error %v selling %s, got %v", c.err, c.item, err)
+		}
+		if res.Status != c.status {
+			t.Fatalf("expected status %s selling %s, got %s", c.status, c.item, res.Status)
+		}
+		if res.Status.Succeeded() != (res.ReceiptID != "") {
+			t.Fatalf("expected a receipt id only for successful sales, got %q for %s", res.ReceiptID, res.Status)
+		}
+	}
+}
+
+// TestSellErrorsRPC tests that the sell errors are returned to a buyer calling
+// the sell RPC, so the buyer can tell them apart.
+func TestSellErrorsRPC(t *testing.T) {
+
+	seller, err := CreateNodeFromConfigFile([]byte(strings.Replace(pricedSeller, "nodeport: 30003", "nodeport: 30005", 1)))
+	if err != nil {
+		t.Fatalf("Error configuring seller for test rpc call: %s", err)
+	}
+	buyer, err := CreateNodeFromConfigFile([]byte(testingConfig))
+	if err != nil {
+		t.Fatalf("Error configuring buyer for test rpc call: %s", err)
+	}
+
+	stopChan := make(chan bool, 1)
+	doneChan := make(chan bool)
+	server := &BazaarServer{node: seller}
+	go server.ListenRPC(stopChan, doneChan)
+	<-doneChan
+	defer close(stopChan)
+
+	sellerPeer := nodeconfig.Peer{PeerID: seller.config.NodeID, Addr: "localhost:30005"}
+	cases := []struct {
+		item    string
+		payment int
+		err     error
+	}{
+		{"fish", 5, nil},
+		{"fish", 5, ErrOutOfStock},
+		{"pigs", 5, ErrUnknownItem},
+		{"salt", 2, ErrInsufficientFunds},
+	}
+	for _, c := range cases {
+		_, err = buyer.callSellRPC(sellerPeer, "", c.item, 1, c.payment)
+		if !errors.Is(err, c.err) {
+			t.Fatalf("expected error %v buying %s, got %v", c.err, c.item, err)
+		}
+	}
+
+	// a buyer that cannot afford the whole order pays what it has, and the
+	// seller partially fills it
+	buyer.config.Balance = 7
+	res, ordered, err := buyer.payAndSell(sellerPeer, "salt", 3, 3)
+	if err != nil || res.Quantity != 2 || ordered != 2 || buyer.balance() != 1 {
+		t.Fatalf("expected 2 salt ordered for 6 out of a balance of 7, got %d salt out of %d and a balance of %d: %v", res.Quantity, ordered, buyer.balance(), err)
+	}
+	if buyer.sellers.latency(seller.config.NodeID) == 0 {
+		t.Fatalf("expected the seller's answer to be timed")
+	}
+	_, _, err = buyer.payAndSell(sellerPeer, "salt", 3, 3)
+	if !errors.Is(err, ErrInsufficientFunds) || buyer.balance() != 1 {
+		t.Fatalf("expected a buyer that cannot pay for a single unit to keep its balance, got a balance of %d: %v", buyer.balance(), err)
+	}
+
+	// a negative buyer id is rejected
+	buyer.config.NodeID = -1
+	_, err = buyer.callSellRPC(sellerPeer, "", "salt", 1, 3)
+	if !errors.Is(err, ErrInvalidBuyer) {
+		t.Fatalf("expected error %v, got %v", ErrInvalidBuyer, err)
+	}
+
+	// a node that is not a seller rejects every sale
+	seller.config.Role = "buyer"
+	buyer.config.NodeID = 1
+	_, err = buyer.callSellRPC(sellerPeer, "", "salt", 1, 3)
+	if !errors.Is(err, ErrNotSeller) {
+		t.Fatalf("expected error %v, got %v", ErrNotSeller, err)
+	}
+}
+
+// TestReserveCommitAbort tests that reserved items are held for the buyer,
+// released on abort, and sold on commit.
+func TestReserveCommitAbort(t *testing.T) {
+
+	// create testnode from test config
+	testnode, err := CreateNodeFromConfigFile([]byte(testingConfig))
+	if err != nil {
+		t.Fatalf("Error configuring node for test rpc call: %s", err)
+		return
+	}
+
+	// only sellers can reserve
+	var rejected ReserveResponse
+	err = testnode.Reserve(ReserveArgs{Item: "fish", BuyerID: 0}, &rejected)
+	if !errors.Is(err, ErrNotSeller) {
+		t.Fatalf("expected a buyer to refuse to reserve, got %v", err)
+	}
+	testnode.config.Role = "seller"
+
+	// there is only one fish, so a second reservation should sell out
+	var first ReserveResponse
+	testnode.Reserve(ReserveArgs{Item: "fish", BuyerID: 0}, &first)
+	if first.Status != StatusReserved {
+		t.Fatalf("expected fish to be reserved, got %s", first.Status)
+	}
+
+	var second ReserveResponse
+	testnode.Reserve(ReserveArgs{Item: "fish", BuyerID: 2}, &second)
+	if second.Status != StatusSoldOut {
+		t.Fatalf("expected fish to be sold out while reserved, got %s", second.Status)
+	}
+
+	// aborting puts the fish back into stock
+	var abortResponse AbortResponse
+	testnode.Abort(CommitArgs{ReservationID: first.ReservationID, BuyerID: 0}, &abortResponse)
+	testnode.Reserve(ReserveArgs{Item: "fish", BuyerID: 2}, &second)
+	if second.Status != StatusReserved {
+		t.Fatalf("expected fish to be reserved after abort, got %s", second.Status)
+	}
+
+	// only the buyer that reserved the fish can commit it
+	var res TransactionResponse
+	testnode.Commit(CommitArgs{ReservationID: second.ReservationID, BuyerID: 0}, &res)
+	if res.Status != StatusNoReservation || !errors.Is(statusError(res.Status), ErrNoReservation) {
+		t.Fatalf("expected commit from another buyer to fail, got %s", res.Status)
+	}
+
+	testnode.Commit(CommitArgs{ReservationID: second.ReservationID, BuyerID: 2}, &res)
+	if res.Status != StatusSold || res.Remaining != 0 {
+		t.Fatalf("expected fish to be sold with none remaining, got %s with %d remaining", res.Status, res.Remaining)
+	}
+
+	// a repeated commit gets the outcome of the first one, and sells nothing
+	var retry TransactionResponse
+	testnode.Commit(CommitArgs{ReservationID: second.ReservationID, BuyerID: 2}, &retry)
+	if retry != res || testnode.balance() != res.Price {
+		t.Fatalf("expected repeated commit to return %v and be paid once, got %v and a balance of %d", res, retry, testnode.balance())
+	}
+}
+
+// TestReservationExpires tests that reserved items go back into stock when
+// the lease runs out.
+func TestReservationExpires(t *testing.T) {
+
+	// create testnode from test config
+	testnode, err := CreateNodeFromConfigFile([]byte(testingConfig))
+	if err != nil {
+		t.Fatalf("Error configuring node for test rpc call: %s", err)
+		return
+	}
+
+	// only sellers can sell
+	testnode.config.Role = "seller"
+	testnode.config.ReservationLease = 10 * time.Millisecond
+
+	var reserved ReserveResponse
+	testnode.Reserve(ReserveArgs{Item: "fish", BuyerID: 0}, &reserved)
+	if reserved.Status != StatusReserved {
+		t.Fatalf("expected fish to be reserved, got %s", reserved.Status)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+
+	var res TransactionResponse
+	testnode.Commit(CommitArgs{ReservationID: reserved.ReservationID, BuyerID: 0}, &res)
+	if res.Status != StatusNoReservation {
+		t.Fatalf("expected expired reservation to fail commit, got %s", res.Status)
+	}
+
+	testnode.Sell(TransactionArgs{CurrentTarget: "fish", BuyerID: 0}, &res)
+	if res.Status != StatusSold {
+		t.Fatalf("expected expired fish to be back in stock, got %s", res.Status)
+	}
+}
+
+// pricedSeller sells salt at 3 and fish at 5, and starts with a balance of 10.
+const pricedSeller string = `
+role: "seller"
+items:
+  - item: "salt"
+    amount: 10
+    unlimited: false
+    price: 3
+  - item: "fish"
+    amount: 1
+    unlimited: false
+    price: 5
+
+balance: 10
+maxpeers: 1
+maxhops: 1
+nodeid: 3
+nodeport: 30003
+`
+
+// pricedNode returns pricedSeller as the node with the given id, listening on
+// port 30000 plus the id, so tests can run several priced nodes at once.
+func pricedNode(id int) string {
+	config := strings.Replace(pricedSeller, "nodeport: 30003", fmt.Sprintf("nodeport: %d", 30000+id), 1)
+	return strings.Replace(config, "nodeid: 3", fmt.Sprintf("nodeid: %d", id), 1)
+}
+
+// TestSellPrices tests that sellers reject payments that do not cover the
+// price, and are paid for the items they sell.
+func TestSellPrices(t *testing.T) {
+
+	// create testnode from test config
+	testnode, err := CreateNodeFromConfigFile([]byte(pricedSeller))
+	if err != nil {
+		t.Fatalf("Error configuring node for test rpc call: %s", err)
+		return
+	}
+
+	var res TransactionResponse
+	testnode.Sell(TransactionArgs{CurrentTarget: "fish", BuyerID: 0, Payment: 4}, &res)
+	if res.Status != StatusInsufficientFunds {
+		t.Fatalf("expected a payment of 4 for fish to be rejected, got %s", res.Status)
+	}
+	if testnode.config.Items[1].Amount != 1 || testnode.balance() != 10 {
+		t.Fatalf("expected rejected sale to leave stock and balance alone")
+	}
+
+	testnode.Sell(TransactionArgs{CurrentTarget: "salt", BuyerID: 0, Payment: 4}, &res)
+	if res.Status != StatusSold || res.Price != 3 {
+		t.Fatalf("expected salt to be sold for 3, got %s for %d", res.Status, res.Price)
+	}
+	if testnode.balance() != 13 {
+		t.Fatalf("expected seller balance of 13, got %d", testnode.balance())
+	}
+
+	// the buyer side cannot withdraw more than it has
+	if testnode.withdraw(14) {
+		t.Fatalf("expected withdrawing more than the balance to fail")
+	}
+	if !testnode.withdraw(13) || testnode.balance() != 0 {
+		t.Fatalf("expected withdrawing the whole balance to leave nothing")
+	}
+}
+
+// TestSellPartialFill tests that sellers fill as much of a multi-unit order as
+// their stock and the buyer's payment allow.
+func TestSellPartialFill(t *testing.T) {
+
+	// create testnode from test config
+	testnode, err := CreateNodeFromConfigFile([]byte(pricedSeller))
+	if err != nil {
+		t.Fatalf("Error configuring node for test rpc call: %s", err)
+		return
+	}
+
+	// the payment only covers 2 units of salt at 3 each
+	var res TransactionResponse
+	testnode.Sell(TransactionArgs{CurrentTarget: "salt", BuyerID: 0, Quantity: 5, Payment: 7}, &res)
+	if res.Status != StatusSold || res.Quantity != 2 || res.Price != 6 {
+		t.Fatalf("expected 2 salt sold for 6, got %s with %d sold for %d", res.Status, res.Quantity, res.Price)
+	}
+
+	// a commit only buys the reserved units the payment covers, and the
+	// rest go back into stock
+	var reserved ReserveResponse
+	testnode.Reserve(ReserveArgs{Item: "salt", BuyerID: 0, Quantity: 3}, &reserved)
+	testnode.Commit(CommitArgs{ReservationID: reserved.ReservationID, BuyerID: 0, Payment: 7}, &res)
+	if res.Status != StatusSold || res.Quantity != 2 || res.Price != 6 || res.Remaining != 6 {
+		t.Fatalf("expected 2 salt sold for 6 with 6 remaining, got %s with %d sold for %d and %d remaining", res.Status, res.Quantity, res.Price, res.Remaining)
+	}
+
+	// only 6 salt are left
+	testnode.Sell(TransactionArgs{CurrentTarget: "salt", BuyerID: 0, Quantity: 12, Payment: 36}, &res)
+	if res.Status != StatusSold || res.Quantity != 6 || res.Remaining != 0 {
+		t.Fatalf("expected the remaining 6 salt to be sold, got %s with %d sold and %d remaining", res.Status, res.Quantity, res.Remaining)
+	}
+
+	// unlimited items are restocked until the order can be filled
+	unlimitedNode, err := CreateNodeFromConfigFile([]byte(testingConfig))
+	if err != nil {
+		t.Fatalf("Error configuring node for test rpc call: %s", err)
+		return
+	}
+	unlimitedNode.config.Role = "seller"
+	unlimitedNode.Sell(TransactionArgs{CurrentTarget: "boars", BuyerID: 0, Quantity: 25}, &res)
+	if res.Status != StatusRestocked || res.Quantity != 25 || res.Remaining != 5 {
+		t.Fatalf("expected 25 boars sold after restocking with 5 remaining, got %s with %d sold and %d remaining", res.Status, res.Quantity, res.Remaining)
+	}
+}
+
+// TestSellIdempotent tests that a retried sell request returns the original
+// outcome instead of selling again, and that the seller only remembers a
+// bounded number of requests.
+func TestSellIdempotent(t *testing.T) {
+
+	// create testnode from test config
+	testnode, err := CreateNodeFromConfigFile([]byte(testingConfig))
+	if err != nil {
+		t.Fatalf("Error configuring node for test rpc call: %s", err)
+		return
+	}
+
+	// only sellers can sell
+	testnode.config.Role = "seller"
+	testnode.recentSells = newRequestCache(2)
+
+	args := TransactionArgs{CurrentTarget: "salt", BuyerID: 0, RequestID: "a"}
+	var first, retry TransactionResponse
+	testnode.Sell(args, &first)
+	testnode.Sell(args, &retry)
+	if retry != first {
+		t.Fatalf("expected retry to return %v, got %v", first, retry)
+	}
+	if testnode.config.Items[0].Amount != 9 {
+		t.Fatalf("expected salt to be sold once, %d remaining", testnode.config.Items[0].Amount)
+	}
+
+	// the same request id from another buyer is a different request
+	testnode.Sell(TransactionArgs{CurrentTarget: "salt", BuyerID: 2, RequestID: "a"}, &retry)
+	if retry.ReceiptID == first.ReceiptID {
+		t.Fatalf("expected a new sale for another buyer")
+	}
+
+	// request a is evicted once two newer requests come in
+	testnode.Sell(TransactionArgs{CurrentTarget: "salt", BuyerID: 0, RequestID: "b"}, &retry)
+	testnode.Sell(args, &retry)
+	if retry.ReceiptID == first.ReceiptID || testnode.config.Items[0].Amount != 6 {
+		t.Fatalf("expected evicted request to be sold again")
+	}
+}
+
+// restockSeller has an item for each restock policy.
+const restockSeller string = `
+role: "seller"
+items:
+  - item: "salt"
+    amount: 0
+    unlimited: false
+    restock:
+      mode: "batch"
+      batch: 4
+      max: 6
+  - item: "fish"
+    amount: 0
+    unlimited: false
+    restock:
+      mode: "periodic"
+      batch: 5
+      interval: 1h
+      max: 8
+  - item: "boars"
+    amount: 1
+    unlimited: true
+    restock:
+      mode: "never"
+
+maxpeers: 1
+maxhops: 1
+nodeid: 4
+nodeport: 30004
+`
+
+// TestRestockPolicies tests batch, periodic, and never restock policies, and
+// that restocks never go over the cap.
+func TestRestockPolicies(t *testing.T) {
+
+	// create testnode from test config
+	testnode, err := CreateNodeFromConfigFile([]byte(restockSeller))
+	if err != nil {
+		t.Fatalf("Error configuring node for test rpc call: %s", err)
+		return
+	}
+
+	// salt is restocked 4 and then 2 at a time, up to the cap of 6
+	var res TransactionResponse
+	testnode.Sell(TransactionArgs{CurrentTarget: "salt", BuyerID: 0, Quantity: 10}, &res)
+	if res.Status != StatusRestocked || res.Quantity != 6 {
+		t.Fatalf("expected 6 salt sold after restocking, got %s with %d sold", res.Status, res.Quantity)
+	}
+
+	// fish is only restocked periodically
+	testnode.Sell(TransactionArgs{CurrentTarget: "fish", BuyerID: 0}, &res)
+	if res.Status != StatusSoldOut {
+		t.Fatalf("expected fish to be sold out before the periodic restock, got %s", res.Status)
+	}
+	select {
+	case <-testnode.catalogChanged:
+	default:
+	}
+	testnode.restockPeriodic(1)
+	select {
+	case <-testnode.catalogChanged:
+	default:
+		t.Fatalf("expected restocking sold out fish to invalidate the catalog")
+	}
+	testnode.restockPeriodic(1)
+	if testnode.config.Items[1].Amount != 8 {
+		t.Fatalf("expected periodic restocks to stop at the cap of 8, got %d", testnode.config.Items[1].Amount)
+	}
+	select {
+	case <-testnode.catalogChanged:
+		t.Fatalf("expected restocking fish that was in stock to leave the catalog alone")
+	default:
+	}
+
+	// the never policy overrides unlimited
+	testnode.Sell(TransactionArgs{CurrentTarget: "boars", BuyerID: 0, Quantity: 2}, &res)
+	if res.Status != StatusSold || res.Quantity != 1 {
+		t.Fatalf("expected only the one boar to be sold, got %s with %d sold", res.Status, res.Quantity)
+	}
+
+	_, err = CreateNodeFromConfigFile([]byte(strings.Replace(restockSeller, "interval: 1h", "interval: 0s", 1)))
+	if err == nil {
+		t.Fatalf("expected a periodic restock without an interval to be rejected")
+	}
+}
+
+// TestLedgerReplay tests that a seller restarted with its ledger comes back
+// with the inventory and balance it had before it stopped.
+func TestLedgerReplay(t *testing.T) {
+
+	dir := t.TempDir()
+	configPath := filepath.Join(dir, "node3.yml")
+	ledgerPath := filepath.Join(dir, "ledger3.jsonl")
+	err := ioutil.WriteFile(configPath, []byte(pricedSeller), 0666)
+	if err != nil {
+		t.Fatalf("Error writing config: %s", err)
+	}
+
+	testnode, err := CreateNodeFromConfigPath(configPath, ledgerPath)
+	if err != nil {
+		t.Fatalf("Error configuring node from path: %s", err)
+	}
+
+	var res TransactionResponse
+	testnode.Sell(TransactionArgs{CurrentTarget: "salt", BuyerID: 0, Payment: 3}, &res)
+	testnode.Sell(TransactionArgs{CurrentTarget: "fish", BuyerID: 0, Payment: 5}, &res)
+	testnode.ledger.Close()
+
+	// simulate a crash in the middle of writing an entry
+	ledgerFile, err := os.OpenFile(ledgerPath, os.O_APPEND|os.O_WRONLY, 0666)
+	if err != nil {
+		t.Fatalf("Error opening ledger: %s", err)
+	}
+	ledgerFile.WriteString(`{"kind":"sale","ite`)
+	ledgerFile.Close()
+
+	restarted, err := CreateNodeFromConfigPath(configPath, ledgerPath)
+	if err != nil {
+		t.Fatalf("Error restarting node from ledger: %s", err)
+	}
+
+	if restarted.config.Items[0].Amount != 9 || restarted.config.Items[1].Amount != 0 {
+		t.Fatalf("expected 9 salt and 0 fish after replay, got %v", restarted.config.Items)
+	}
+	if restarted.balance() != 18 {
+		t.Fatalf("expected balance of 18 after replay, got %d", restarted.balance())
+	}
+	if restarted.config.SellerTarget != "salt" {
+		t.Fatalf("expected sold out fish not to be the seller target after replay")
+	}
+
+	// the partial entry is dropped, so new entries can be replayed again
+	restarted.Sell(TransactionArgs{CurrentTarget: "salt", BuyerID: 0, Payment: 3}, &res)
+	restarted.ledger.Close()
+	_, entries, err := OpenLedger(ledgerPath)
+	if err != nil {
+		t.Fatalf("Error reopening ledger: %s", err)
+	}
+	if len(entries) != 3 {
+		t.Fatalf("expected 3 ledger entries, got %d", len(entries))
+	}
+
+	// an entry is only complete once its newline is written, even if what
+	// was written is valid JSON
+	ledgerFile, err = os.OpenFile(ledgerPath, os.O_APPEND|os.O_WRONLY, 0666)
+	if err != nil {
+		t.Fatalf("Error opening ledger: %s", err)
+	}
+	ledgerFile.WriteString(`{"kind":"sale","item":"salt","quantity":1}`)
+	ledgerFile.Close()
+	ledger, entries, err := OpenLedger(ledgerPath)
+	if err != nil {
+		t.Fatalf("Error reopening ledger: %s", err)
+	}
+	ledger.Close()
+	if len(entries) != 3 {
+		t.Fatalf("expected the unterminated entry to be dropped, got %d entries", len(entries))
+	}
+
+	// a complete line that is not an entry is corruption
+	ledgerFile, err = os.OpenFile(ledgerPath, os.O_APPEND|os.O_WRONLY, 0666)
+	if err != nil {
+		t.Fatalf("Error opening ledger: %s", err)
+	}
+	ledgerFile.WriteString("{\"kind\":\"sale\",\"ite\n")
+	ledgerFile.Close()
+	_, _, err = OpenLedger(ledgerPath)
+	if err == nil {
+		t.Fatalf("expected a corrupt ledger entry to be an error")
+	}
+}
+
+// TestPendingPayment tests that a payment whose outcome is unknown stays
+// withdrawn when the buyer is restarted from its ledger, and that settling it
+// refunds what the seller did not charge.
+func TestPendingPayment(t *testing.T) {
+
+	dir := t.TempDir()
+	configPath := filepath.Join(dir, "node3.yml")
+	ledgerPath := filepath.Join(dir, "ledger3.jsonl")
+	err := ioutil.WriteFile(configPath, []byte(pricedSeller), 0666)
+	if err != nil {
+		t.Fatalf("Error writing config: %s", err)
+	}
+
+	testnode, err := CreateNodeFromConfigPath(configPath, ledgerPath)
+	if err != nil {
+		t.Fatalf("Error configuring node from path: %s", err)
+	}
+
+	// the seller never answers, so the payment is held
+	seller := nodeconfig.Peer{PeerID: 21, Addr: "localhost:30021"}
+	testnode.withdraw(6)
+	pending := LedgerEntry{Item: "salt", Quantity: 2, Price: 6, Counterparty: seller.PeerID, Request: "request"}
+	testnode.holdPayment(seller, pending, func() (TransactionResponse, error) {
+		return TransactionResponse{}, ErrRPCTimeout
+	})
+
+	restarted, err := CreateNodeFromConfigPath(configPath, ledgerPath)
+	if err != nil {
+		t.Fatalf("Error restarting node from ledger: %s", err)
+	}
+	restarted.ledger.Close()
+	if restarted.balance() != testnode.balance() || testnode.balance() != 4 {
+		t.Fatalf("expected the pending payment to stay withdrawn after replay, got a balance of %d and %d", restarted.balance(), testnode.balance())
+	}
+
+	// the seller only sold one of the items, so the rest is refunded
+	testnode.settlePayment(pending, TransactionResponse{Status: StatusSold, Quantity: 1, Price: 3, ReceiptID: "receipt"}, nil)
+	testnode.ledger.Close()
+	if testnode.balance() != 7 {
+		t.Fatalf("expected a balance of 7 after settling, got %d", testnode.balance())
+	}
+
+	restarted, err = CreateNodeFromConfigPath(configPath, ledgerPath)
+	if err != nil {
+		t.Fatalf("Error restarting node from ledger: %s", err)
+	}
+	restarted.ledger.Close()
+	if restarted.balance() != 7 {
+		t.Fatalf("expected a balance of 7 after replaying the settled payment, got %d", restarted.balance())
+	}
+}
+
+// TestSnapshotRoundTrip tests that a snapshot can be loaded as a config, and
+// that the loaded node continues with the state of the original node.
+func TestSnapshotRoundTrip(t *testing.T) {
+
+	// create testnode from test config
+	testnode, err := CreateNodeFromConfigFile([]byte(pricedSeller))
+	if err != nil {
+		t.Fatalf("Error configuring node for test rpc call: %s", err)
+		return
+	}
+	testnode.config.ReservationLease = time.Minute
+	testnode.SnapshotPath = filepath.Join(t.TempDir(), "snapshot3.yml")
+
+	// sell all the fish, and hold two salt in a reservation
+	var res TransactionResponse
+	testnode.Sell(TransactionArgs{CurrentTarget: "fish", BuyerID: 0, Payment: 5}, &res)
+	testnode.Sell(TransactionArgs{CurrentTarget: "salt", BuyerID: 0, Payment: 3}, &res)
+	var reserved ReserveResponse
+	testnode.Reserve(ReserveArgs{Item: "salt", BuyerID: 0, Quantity: 2}, &reserved)
+
+	var snapshot SnapshotResponse
+	err = testnode.Snapshot(SnapshotArgs{}, &snapshot)
+	if err != nil {
+		t.Fatalf("Error taking snapshot: %s", err)
+	}
+
+	written, err := ioutil.ReadFile(snapshot.Path)
+	if err != nil || string(written) != string(snapshot.Config) {
+		t.Fatalf("expected snapshot to be written to %s", testnode.SnapshotPath)
+	}
+
+	restored, err := CreateNodeFromConfigFile(snapshot.Config)
+	if err != nil {
+		t.Fatalf("Error loading snapshot: %s", err)
+	}
+
+	// the reserved salt is back in stock
+	if restored.config.Items[0].Amount != 9 || restored.config.Items[1].Amount != 0 {
+		t.Fatalf("expected 9 salt and 0 fish in snapshot, got %v", restored.config.Items)
+	}
+	if restored.config.Balance != 18 || restored.config.SellerTarget != "salt" {
+		t.Fatalf("expected balance 18 selling salt, got balance %d selling %s", restored.config.Balance, restored.config.SellerTarget)
+	}
+	if restored.config.ReservationLease != time.Minute {
+		t.Fatalf("expected reservation lease of a minute, got %s", restored.config.ReservationLease)
+	}
+
+	// receipt ids carry on from the sales made before the snapshot
+	restored.Sell(TransactionArgs{CurrentTarget: "salt", BuyerID: 0, Payment: 3}, &res)
+	if res.ReceiptID != "3-0-3" {
+		t.Fatalf("expected the receipt id to carry on from the snapshot, got %s", res.ReceiptID)
+	}
+
+	// the snapshot already includes the ledger's entries, so it only starts
+	// with a new ledger
+	ledgerPath := filepath.Join(t.TempDir(), "ledger3.jsonl")
+	_, err = CreateNodeFromConfigPath(snapshot.Path, ledgerPath)
+	if err != nil {
+		t.Fatalf("Error loading snapshot with a new ledger: %s", err)
+	}
+	err = ioutil.WriteFile(ledgerPath, []byte(`{"kind":"sale","item":"salt","quantity":1,"price":3}`+"\n"), 0666)
+	if err != nil {
+		t.Fatalf("Error writing ledger: %s", err)
+	}
+	_, err = CreateNodeFromConfigPath(snapshot.Path, ledgerPath)
+	if err == nil {
+		t.Fatalf("expected a snapshot with a ledger that has entries to be rejected")
+	}
+}
+
+// TestLookupSellerModes tests that sellers in the "all" seller mode reply for
+// every item they can sell, while sellers in the "target" seller mode only
+// reply for their seller target.
+func TestLookupSellerModes(t *testing.T) {
+
+	for _, mode := range []string{nodeconfig.SellerModeTarget, nodeconfig.SellerModeAll} {
+		testnode, err := CreateNodeFromConfigFile([]byte(pricedSeller + "sellermode: " + mode + "\n"))
+		if err != nil {
+			t.Fatalf("Error configuring node for test rpc call: %s", err)
+			return
+		}
+		testnode.config.SellerTarget = "salt"
+
+		// an empty route means the seller is replying to itself, so replies
+		// are delivered to its own lookups
+		var rpcResponse LookupResponse
+		for uuid, item := range []string{"salt", "fish", "boars"} {
+			testnode.openReplies(int64(uuid))
+			args := LookupArgs{ProductName: item, HopCount: 0, BuyerID: testnode.config.NodeID, Route: []nodeconfig.Peer{}, UUID: int64(uuid)}
+			testnode.Lookup(args, &rpcResponse)
+		}
+
+		// replies are sent in goroutines
+		time.Sleep(50 * time.Millisecond)
+
+		replies := make(map[string]Offer)
+		for uuid := range []string{"salt", "fish", "boars"} {
+			for _, quote := range testnode.closeReplies(int64(uuid)) {
+				replies[quote.Item] = quote
+			}
+		}
+
+		if salt, ok := replies["salt"]; !ok || salt.Available != 10 || salt.Price != 3 {
+			t.Fatalf("expected a reply for 10 salt at 3 in mode %s, got %v", mode, replies)
+		}
+		if _, ok := replies["boars"]; ok {
+			t.Fatalf("expected no reply for boars in mode %s", mode)
+		}
+		if _, ok := replies["fish"]; ok != (mode == nodeconfig.SellerModeAll) {
+			t.Fatalf("expected a reply for fish only in the all seller mode, got %v in mode %s", replies, mode)
+		}
+	}
+
+	_, err := CreateNodeFromConfigFile([]byte(pricedSeller + "sellermode: some\n"))
+	if err == nil {
+		t.Fatalf("expected an unknown seller mode to be rejected")
+	}
+}
+
+// TestLookupDuplicateSuppression tests that a node drops a lookup that reaches
+// it a second time, and handles it again once the cache entry expires.
+func TestLookupDuplicateSuppression(t *testing.T) {
+
+	testnode, err := CreateNodeFromConfigFile([]byte(pricedSeller + "lookupcachettl: 20ms\n"))
+	if err != nil {
+		t.Fatalf("Error configuring node for test rpc call: %s", err)
+		return
+	}
+	testnode.config.SellerTarget = "salt"
+
+	// the same lookup arrives twice, and a different lookup from another
+	// buyer with the same uuid arrives once
+	var rpcResponse LookupResponse
+	replies := testnode.openReplies(7)
+	args := LookupArgs{ProductName: "salt", HopCount: 0, BuyerID: testnode.config.NodeID, Route: []nodeconfig.Peer{}, UUID: 7}
+	testnode.Lookup(args, &rpcResponse)
+	testnode.Lookup(args, &rpcResponse)
+
+	time.Sleep(10 * time.Millisecond)
+	if len(replies) != 1 {
+		t.Fatalf("expected one reply to a repeated lookup, got %d", len(replies))
+	}
+	if testnode.seenLookups.suppressedCount() != 1 {
+		t.Fatalf("expected one suppressed lookup, got %d", testnode.seenLookups.suppressedCount())
+	}
+
+	if ok, _ := testnode.seenLookups.markSeen(lookupKey{buyerID: 5, uuid: 7}, 0); !ok {
+		t.Fatalf("expected a lookup from another buyer with the same uuid not to be suppressed")
+	}
+
+	// a copy with more hops left is handled, but the seller does not reply
+	// to it again
+	more := args
+	more.HopCount = 1
+	testnode.Lookup(more, &rpcResponse)
+	time.Sleep(10 * time.Millisecond)
+	if len(replies) != 1 || testnode.seenLookups.suppressedCount() != 1 {
+		t.Fatalf("expected a copy with more hops to be handled without a second reply, got %d replies and %d suppressed", len(replies), testnode.seenLookups.suppressedCount())
+	}
+	testnode.Lookup(more, &rpcResponse)
+	if testnode.seenLookups.suppressedCount() != 2 {
+		t.Fatalf("expected a copy with as many hops to be suppressed, got %d suppressed", testnode.seenLookups.suppressedCount())
+	}
+
+	// once the entry expires, the lookup is handled again
+	time.Sleep(30 * time.Millisecond)
+	testnode.Lookup(args, &rpcResponse)
+	time.Sleep(10 * time.Millisecond)
+	if len(replies) != 2 {
+		t.Fatalf("expected the lookup to be handled again after expiring, got %d replies", len(replies))
+	}
+}
+
+// TestRandomWalk tests that every walker of a random walk lookup is handled on
+// its own, and that walkers are only sent on to neighbours they have not
+// visited.
+func TestRandomWalk(t *testing.T) {
+
+	testnode, err := CreateNodeFromConfigFile([]byte(pricedSeller + "search: randomwalk\nwalkers: 3\n"))
+	if err != nil {
+		t.Fatalf("Error configuring node for test rpc call: %s", err)
+		return
+	}
+	testnode.config.SellerTarget = "salt"
+
+	// the seller is the buyer's own node, so each walker replies straight away
+	replies := testnode.openReplies(1)
+	testnode.startLookup(LookupArgs{ProductName: "salt", HopCount: 0, BuyerID: testnode.config.NodeID, Route: []nodeconfig.Peer{}, UUID: 1})
+	time.Sleep(10 * time.Millisecond)
+	if len(replies) != 3 {
+		t.Fatalf("expected a reply for each of the 3 walkers, got %d", len(replies))
+	}
+
+	testnode.config.Peers = map[int]string{4: "localhost:30006", 5: "localhost:30007", 6: "localhost:30008"}
+	route := []nodeconfig.Peer{{PeerID: 4}, {PeerID: 5}}
+	for i := 0; i < 10; i++ {
+		peer, ok := testnode.nextWalkerPeer(route)
+		if !ok || peer.PeerID != 6 || peer.Addr != "localhost:30008" {
+			t.Fatalf("expected the walker to be sent to the only unvisited peer 6, got %v (%t)", peer, ok)
+		}
+	}
+
+	route = append(route, nodeconfig.Peer{PeerID: 6})
+	if peer, ok := testnode.nextWalkerPeer(route); ok {
+		t.Fatalf("expected the walker to stop once every peer is visited, got %v", peer)
+	}
+
+	_, err = CreateNodeFromConfigFile([]byte(pricedSeller + "search: gossip\n"))
+	if err == nil {
+		t.Fatalf("expected an unknown search strategy to be rejected")
+	}
+}
+
+// TestExpandingRing tests that an expanding ring search stops at the first
+// ring with a reply, and otherwise grows the ring until it reaches max hops.
+func TestExpandingRing(t *testing.T) {
+
+	testnode, err := CreateNodeFromConfigFile([]byte(pricedSeller + "expandingring: true\n"))
+	if err != nil {
+		t.Fatalf("Error configuring node for test rpc call: %s", err)
+		return
+	}
+	testnode.config.Role = "both"
+	testnode.config.SellerTarget = "salt"
+	testnode.config.MaxHops = 3
+
+	// the buyer sells salt itself, so it is found in the first ring
+	_, hopcount, sellers := testnode.search("salt", nodeconfig.LookupFilter{})
+	if len(sellers) != 1 || hopcount != 1 {
+		t.Fatalf("expected one seller of salt within one hop, got %d within %d hops", len(sellers), hopcount)
+	}
+	if testnode.state.RingLookups != 1 || testnode.state.RingRadius != 1 {
+		t.Fatalf("expected salt to be found within one hop, got %d lookups with total radius %d", testnode.state.RingLookups, testnode.state.RingRadius)
+	}
+
+	// nobody sells boars, so every ring up to max hops is tried
+	first := testnode.GetLookupUUID()
+	last, hopcount, sellers := testnode.search("boars", nodeconfig.LookupFilter{})
+	if len(sellers) != 0 || hopcount != 3 {
+		t.Fatalf("expected no sellers of boars within 3 hops, got %d within %d hops", len(sellers), hopcount)
+	}
+	if last-first != 3 {
+		t.Fatalf("expected a lookup for each of the 3 rings, got %d", last-first)
+	}
+	if testnode.state.RingLookups != 1 {
+		t.Fatalf("expected lookups without sellers not to count towards the radius, got %d lookups", testnode.state.RingLookups)
+	}
+}
+
+// TestReplyPolicies tests that the buyer stops collecting replies as its
+// reply policy says, and drops replies that arrive late.
+func TestReplyPolicies(t *testing.T) {
+
+	testnode, err := CreateNodeFromConfigFile([]byte(pricedSeller + "replypolicy: first\nreplytimeout: 1s\n"))
+	if err != nil {
+		t.Fatalf("Error configuring node for test rpc call: %s", err)
+		return
+	}
+	testnode.config.Role = "both"
+	testnode.config.SellerTarget = "salt"
+
+	// the buyer sells salt itself, so the first reply comes in right away
+	start := time.Now()
+	lookupUUID, _, sellers := testnode.search("salt", nodeconfig.LookupFilter{})
+	if len(sellers) != 1 || time.Since(start) > 500*time.Millisecond {
+		t.Fatalf("expected to stop at the first reply, got %d replies after %s", len(sellers), time.Since(start))
+	}
+
+	// the lookup is closed, so another reply to it is late
+	testnode.deliverReply(lookupUUID, sellers[0])
+	if testnode.state.LateReplies != 1 {
+		t.Fatalf("expected one late reply, got %d", testnode.state.LateReplies)
+	}
+
+	// a lookup that got the replies it wanted is cancelled right away
+	testnode.config.CancelLookups = true
+	lookupUUID, _, _ = testnode.search("salt", nodeconfig.LookupFilter{})
+	if !testnode.isCancelled(testnode.config.NodeID, lookupUUID) {
+		t.Fatalf("expected the lookup to be cancelled once the first reply came in")
+	}
+
+	// there is only one seller, so waiting for two replies takes until the
+	// timeout, and the lookup is not cancelled
+	testnode.config.ReplyPolicy = nodeconfig.ReplyPolicyFirstN
+	testnode.config.ReplyCount = 2
+	testnode.config.ReplyTimeout = 50 * time.Millisecond
+	start = time.Now()
+	lookupUUID, _, sellers = testnode.search("salt", nodeconfig.LookupFilter{})
+	if len(sellers) != 1 || time.Since(start) < 50*time.Millisecond {
+		t.Fatalf("expected to wait for the timeout, got %d replies after %s", len(sellers), time.Since(start))
+	}
+	if testnode.isCancelled(testnode.config.NodeID, lookupUUID) {
+		t.Fatalf("expected a lookup that ran until the timeout not to be cancelled")
+	}
+
+	// the deadline cuts the expanding ring short
+	testnode.config.ReplyPolicy = nodeconfig.ReplyPolicyDeadline
+	testnode.config.ReplyDeadline = 80 * time.Millisecond
+	testnode.config.ExpandingRing = true
+	testnode.config.MaxHops = 5
+	first := testnode.GetLookupUUID()
+	last, _, sellers := testnode.search("boars", nodeconfig.LookupFilter{})
+	if len(sellers) != 0 || last-first != 2 {
+		t.Fatalf("expected two rings before the deadline, got %d rings", last-first)
+	}
+
+	_, err = CreateNodeFromConfigFile([]byte(pricedSeller + "replypolicy: deadline\n"))
+	if err == nil {
+		t.Fatalf("expected the deadline reply policy without a deadline to be rejected")
+	}
+}
+
+// TestLookupFilters tests that buyer options can carry lookup filters, and
+// that sellers only reply to lookups whose filter they pass.
+func TestLookupFilters(t *testing.T) {
+
+	testnode, err := CreateNodeFromConfigFile([]byte(pricedSeller + `buyeroptionlist:
+  - "fish"
+  - item: "salt"
+    maxprice: 4
+    excludesellers: [7]
+`))
+	if err != nil {
+		t.Fatalf("Error configuring node for test rpc call: %s", err)
+		return
+	}
+
+	options := testnode.config.BuyerOptionList
+	if len(options) != 2 || options[0].Item != "fish" || !options[0].LookupFilter.IsEmpty() {
+		t.Fatalf("expected fish without a filter as the first buyer option, got %v", options)
+	}
+	if options[1].Item != "salt" || options[1].MaxPrice != 4 || len(options[1].ExcludeSellers) != 1 {
+		t.Fatalf("expected salt with a filter as the second buyer option, got %v", options[1])
+	}
+
+	// the options are written back out in a form that can be read again
+	config, err := testnode.snapshot()
+	if err != nil {
+		t.Fatalf("Error taking snapshot: %s", err)
+	}
+	restored, err := CreateNodeFromConfigFile(config)
+	if err != nil {
+		t.Fatalf("Error configuring node from snapshot: %s", err)
+	}
+	if len(restored.config.BuyerOptionList) != 2 || restored.config.BuyerOptionList[1].MaxPrice != 4 {
+		t.Fatalf("expected the buyer options to survive a snapshot, got %v", restored.config.BuyerOptionList)
+	}
+
+	// salt is priced at 3, and the seller has 10 of them
+	testnode.config.SellerTarget = "salt"
+	id := testnode.config.NodeID
+	filters := []struct {
+		filter nodeconfig.LookupFilter
+		reply  bool
+	}{
+		{nodeconfig.LookupFilter{}, true},
+		{nodeconfig.LookupFilter{MaxPrice: 3, MinQuantity: 10}, true},
+		{nodeconfig.LookupFilter{MaxPrice: 2}, false},
+		{nodeconfig.LookupFilter{MinQuantity: 11}, false},
+		{nodeconfig.LookupFilter{ExcludeSellers: []int{id}}, false},
+		{nodeconfig.LookupFilter{RequireSellers: []int{id + 1}}, false},
+		{nodeconfig.LookupFilter{RequireSellers: []int{id + 1, id}}, true},
+	}
+
+	var rpcResponse LookupResponse
+	for i, test := range filters {
+		uuid := int64(i)
+		replies := testnode.openReplies(uuid)
+		args := LookupArgs{ProductName: "salt", HopCount: 0, BuyerID: id, Route: []nodeconfig.Peer{}, UUID: uuid, Filter: test.filter}
+		testnode.Lookup(args, &rpcResponse)
+		time.Sleep(10 * time.Millisecond)
+
+		replied := len(replies) == 1
+		if replied != test.reply {
+			t.Fatalf("expected reply %t for filter %+v, got %t", test.reply, test.filter, replied)
+		}
+	}
+}
+
+// TestLookupOffers tests that sellers reply to lookups with an offer that
+// describes the item and expires after the seller's offer TTL.
+func TestLookupOffers(t *testing.T) {
+
+	testnode, err := CreateNodeFromConfigFile([]byte(pricedSeller + "offerttl: 20ms\n"))
+	if err != nil {
+		t.Fatalf("Error configuring node for test rpc call: %s", err)
+		return
+	}
+	testnode.config.SellerTarget = "salt"
+
+	var rpcResponse LookupResponse
+	replies := testnode.openReplies(1)
+	args := LookupArgs{ProductName: "salt", HopCount: 0, BuyerID: testnode.config.NodeID, Route: []nodeconfig.Peer{}, UUID: 1}
+	testnode.Lookup(args, &rpcResponse)
+	offer := <-replies
+
+	if offer.Seller.PeerID != testnode.config.NodeID || offer.Item != "salt" || offer.Available != 10 || offer.Unlimited || offer.Price != 3 {
+		t.Fatalf("expected an offer of 10 salt at 3 from node %d, got %+v", testnode.config.NodeID, offer)
+	}
+	if offer.Hops != 0 {
+		t.Fatalf("expected the buyer's own offer to be zero hops away, got %d", offer.Hops)
+	}
+	if offer.Expired() {
+		t.Fatalf("expected a new offer not to have expired")
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	if !offer.Expired() {
+		t.Fatalf("expected the offer to expire after the offer TTL")
+	}
+}
+
+// TestCatalogAdvertisement tests that nodes answer lookups from advertised
+// catalogs, and that sellers invalidate their catalog when they sell out.
+func TestCatalogAdvertisement(t *testing.T) {
+
+	testnode, err := CreateNodeFromConfigFile([]byte(pricedSeller))
+	if err != nil {
+		t.Fatalf("Error configuring node for test rpc call: %s", err)
+		return
+	}
+	testnode.config.SellerTarget = "salt"
+
+	offers := testnode.catalog()
+	if len(offers) != 1 || offers[0].Item != "salt" || offers[0].Available != 10 || offers[0].Price != 3 {
+		t.Fatalf("expected a catalog with 10 salt at 3, got %+v", offers)
+	}
+
+	// selling every unit invalidates the catalog
+	_, err = testnode.sell("salt", 9, "", 10, 30)
+	if err != nil {
+		t.Fatalf("error selling salt: %s", err)
+	}
+	select {
+	case <-testnode.catalogChanged:
+	default:
+		t.Fatalf("expected selling out to invalidate the catalog")
+	}
+	if offers := testnode.catalog(); len(offers) != 0 {
+		t.Fatalf("expected an empty catalog after selling out, got %+v", offers)
+	}
+
+	// seller 8 advertises salt at 2 to this node through node 9
+	testnode.config.Role = "none"
+	seller := nodeconfig.Peer{PeerID: 8, Addr: "localhost:30009"}
+	advertise := func(seq int64, offers []Offer) {
+		testnode.receiveCatalog(AdvertiseArgs{
+			Seller:  seller,
+			Seq:     seq,
+			Offers:  offers,
+			Expires: time.Now().Add(time.Second),
+			Route:   []nodeconfig.Peer{seller, {PeerID: 9, Addr: "localhost:30010"}},
+		})
+	}
+	lookup := func(uuid int64, filter nodeconfig.LookupFilter) []Offer {
+		var rpcResponse LookupResponse
+		testnode.openReplies(uuid)
+		args := LookupArgs{ProductName: "salt", HopCount: 0, BuyerID: testnode.config.NodeID, Route: []nodeconfig.Peer{}, UUID: uuid, Filter: filter}
+		testnode.Lookup(args, &rpcResponse)
+		time.Sleep(10 * time.Millisecond)
+
+		return testnode.closeReplies(uuid)
+	}
+
+	advertise(2, []Offer{{Seller: seller, Item: "salt", Available: 5, Price: 2}})
+	replies := lookup(1, nodeconfig.LookupFilter{})
+	if len(replies) != 1 || replies[0].Seller.PeerID != 8 || replies[0].Price != 2 || replies[0].Hops != 2 {
+		t.Fatalf("expected a cached offer from seller 8 two hops away, got %+v", replies)
+	}
+	if replies := lookup(2, nodeconfig.LookupFilter{MaxPrice: 1}); len(replies) != 0 {
+		t.Fatalf("expected cached offers to be filtered, got %+v", replies)
+	}
+
+	// an older catalog is ignored, and a newer empty one clears the offers
+	advertise(1, nil)
+	if replies := lookup(3, nodeconfig.LookupFilter{}); len(replies) != 1 {
+		t.Fatalf("expected an older catalog to be ignored, got %+v", replies)
+	}
+	advertise(3, nil)
+	if replies := lookup(4, nodeconfig.LookupFilter{}); len(replies) != 0 {
+		t.Fatalf("expected a newer empty catalog to clear the offers, got %+v", replies)
+	}
+}
+
+// TestCancelLookup tests that nodes drop lookups and replies for a lookup the
+// buyer cancelled.
+func TestCancelLookup(t *testing.T) {
+
+	testnode, err := CreateNodeFromConfigFile([]byte(pricedSeller + "cancellookups: true\n"))
+	if err != nil {
+		t.Fatalf("Error configuring node for test rpc call: %s", err)
+		return
+	}
+	testnode.config.SellerTarget = "salt"
+	id := testnode.config.NodeID
+
+	var cancelResponse CancelLookupResponse
+	testnode.CancelLookup(CancelLookupArgs{BuyerID: id, UUID: 1, Route: []nodeconfig.Peer{}}, &cancelResponse)
+
+	// the cancelled lookup is dropped, and other lookups are not
+	var rpcResponse LookupResponse
+	cancelled := testnode.openReplies(1)
+	replies := testnode.openReplies(2)
+	testnode.Lookup(LookupArgs{ProductName: "salt", HopCount: 0, BuyerID: id, Route: []nodeconfig.Peer{}, UUID: 1}, &rpcResponse)
+	testnode.Lookup(LookupArgs{ProductName: "salt", HopCount: 0, BuyerID: id, Route: []nodeconfig.Peer{}, UUID: 2}, &rpcResponse)
+	time.Sleep(10 * time.Millisecond)
+	if len(cancelled) != 0 || len(replies) != 1 {
+		t.Fatalf("expected only the lookup that was not cancelled to get a reply, got %d and %d", len(cancelled), len(replies))
+	}
+
+	// replies that arrive after the buyer cancelled are dropped
+	replies = testnode.openReplies(3)
+	testnode.cancelBuyerLookup(3, testnode.config.MaxHops)
+	testnode.reply(ReplyArgs{RouteList: []nodeconfig.Peer{testnode.self()}, Offer: Offer{Seller: testnode.self(), Item: "salt"}, LookupUUID: 3})
+	if len(replies) != 0 {
+		t.Fatalf("expected a reply to a cancelled lookup to be dropped")
+	}
+
+	if testnode.state.CancelledLookups != 1 || testnode.state.CancelledReplies != 1 {
+		t.Fatalf("expected one dropped lookup and one dropped reply, got %d and %d", testnode.state.CancelledLookups, testnode.state.CancelledReplies)
+	}
+}
+
+// TestDirectReply tests that sellers in direct reply mode send replies
+// straight to the buyer, and that the buyer records which path replies took.
+func TestDirectReply(t *testing.T) {
+
+	buyer, err := CreateNodeFromConfigFile([]byte(pricedNode(14)))
+	if err != nil {
+		t.Fatalf("Error configuring buyer for test rpc call: %s", err)
+		return
+	}
+	stopChan := make(chan bool, 1)
+	doneChan := make(chan bool)
+	server := &BazaarServer{node: buyer}
+	go server.ListenRPC(stopChan, doneChan)
+	<-doneChan
+	defer close(stopChan)
+
+	seller, err := CreateNodeFromConfigFile([]byte(pricedSeller + "directreply: true\n"))
+	if err != nil {
+		t.Fatalf("Error configuring seller for test rpc call: %s", err)
+		return
+	}
+
+	// the relay in the middle of the route is not listening, so the reply
+	// only arrives if it is sent directly
+	route := []nodeconfig.Peer{buyer.self(), {PeerID: 15, Addr: "localhost:30015"}, seller.self()}
+	replies := buyer.openReplies(1)
+	args := ReplyArgs{RouteList: route, Offer: Offer{Seller: seller.self(), Item: "salt", Hops: 2}, LookupUUID: 1, Started: time.Now()}
+	seller.sendReply(args)
+	time.Sleep(50 * time.Millisecond)
+	if len(replies) != 1 {
+		t.Fatalf("expected the reply to reach the buyer directly, got %d replies", len(replies))
+	}
+	<-replies
+
+	// without direct replies, the reply goes back along the route
+	seller.config.DirectReply = false
+	args.RouteList = []nodeconfig.Peer{buyer.self(), seller.self()}
+	args.Offer.Hops = 1
+	seller.sendReply(args)
+	time.Sleep(50 * time.Millisecond)
+	if len(replies) != 1 {
+		t.Fatalf("expected the reply to reach the buyer along the route, got %d replies", len(replies))
+	}
+
+	buyer.perfLock.Lock()
+	defer buyer.perfLock.Unlock()
+	if buyer.state.RequestCountDirect != 1 || buyer.state.RequestCountReverse != 1 {
+		t.Fatalf("expected one direct and one reverse path reply, got %d and %d", buyer.state.RequestCountDirect, buyer.state.RequestCountReverse)
+	}
+}
+
+// dhtBuyer, dhtRelay and dhtSeller are a line of nodes that use the DHT
+// search strategy. dhtSeller sells salt at 3 and fish at 5.
+const dhtBuyer string = `
+peers:
+  12: localhost:30012
+role: "buyer"
+maxpeers: 1
+maxhops: 1
+nodeid: 11
+nodeport: 30011
+search: "dht"
+`
+
+const dhtRelay string = `
+peers:
+  11: localhost:30011
+  13: localhost:30013
+role: "none"
+maxpeers: 2
+maxhops: 1
+nodeid: 12
+nodeport: 30012
+search: "dht"
+`
+
+const dhtSeller string = `
+peers:
+  12: localhost:30012
+role: "seller"
+items:
+  - item: "salt"
+    amount: 10
+    price: 3
+  - item: "fish"
+    amount: 1
+    price: 5
+maxpeers: 1
+maxhops: 1
+nodeid: 13
+nodeport: 30013
+search: "dht"
+sellertarget: "salt"
+`
+
+// TestDHTLookup tests that sellers register their items with the nodes
+// closest to the item's key, and that buyers find them through the DHT.
+func TestDHTLookup(t *testing.T) {
+
+	var nodes []*BazaarNode
+	for _, config := range []string{dhtBuyer, dhtRelay, dhtSeller} {
+		testnode, err := CreateNodeFromConfigFile([]byte(config))
+		if err != nil {
+			t.Fatalf("Error configuring node for test rpc call: %s", err)
+			return
+		}
+
+		stopChan := make(chan bool, 1)
+		doneChan := make(chan bool)
+		server := &BazaarServer{node: testnode}
+		go server.ListenRPC(stopChan, doneChan)
+		<-doneChan
+		defer close(stopChan)
+
+		nodes = append(nodes, testnode)
+	}
+	buyer, relay, seller := nodes[0], nodes[1], nodes[2]
+
+	published := seller.dhtPublish(nil)
+	time.Sleep(100 * time.Millisecond)
+	if !published["salt"] || len(published) != 1 {
+		t.Fatalf("expected the seller to publish salt, got %v", published)
+	}
+
+	// the buyer learned about the seller, which is not its peer
+	contacts := buyer.routes.closest(nodeKey(seller.config.NodeID), 1)
+	if len(contacts) != 1 || contacts[0].PeerID != seller.config.NodeID {
+		t.Fatalf("expected the buyer to learn about the seller, got %v", contacts)
+	}
+
+	// there are fewer nodes than dhtK, so every node stores the offer. The
+	// buyer forgets its copy, so it has to ask the relay.
+	for _, testnode := range nodes {
+		if offers := testnode.dhtRecords.get(itemKey("salt")); len(offers) != 1 {
+			t.Fatalf("expected node %d to store the salt offer, got %v", testnode.config.NodeID, offers)
+		}
+	}
+	buyer.dhtRecords = newDHTStore()
+
+	replies := buyer.openReplies(1)
+	buyer.startLookup(LookupArgs{ProductName: "salt", BuyerID: buyer.config.NodeID, UUID: 1})
+	if len(replies) != 1 {
+		t.Fatalf("expected one offer for salt, got %d", len(replies))
+	}
+	offer := <-replies
+	if offer.Seller.PeerID != seller.config.NodeID || offer.Price != 3 || offer.Available != 10 || offer.Hops != 1 {
+		t.Fatalf("expected 10 salt at 3 from the seller after one round, got %+v", offer)
+	}
+
+	replies = buyer.openReplies(2)
+	buyer.startLookup(LookupArgs{ProductName: "salt", BuyerID: buyer.config.NodeID, UUID: 2, Filter: nodeconfig.LookupFilter{MaxPrice: 2}})
+	if len(replies) != 0 {
+		t.Fatalf("expected DHT offers to be filtered, got %d", len(replies))
+	}
+
+	// a lookup past its deadline asks no one
+	replies = buyer.openReplies(3)
+	buyer.startLookup(LookupArgs{ProductName: "salt", BuyerID: buyer.config.NodeID, UUID: 3, deadline: time.Now().Add(-time.Millisecond)})
+	if len(replies) != 0 || buyer.state.ExpiredLookups != 1 {
+		t.Fatalf("expected the expired DHT lookup to be dropped, got %d replies and %d expired lookups", len(replies), buyer.state.ExpiredLookups)
+	}
+
+	// switching to fish withdraws the salt offer
+	seller.config.SellerTarget = "fish"
+	published = seller.dhtPublish(published)
+	time.Sleep(100 * time.Millisecond)
+	if offers := relay.dhtRecords.get(itemKey("salt")); len(offers) != 0 {
+		t.Fatalf("expected the salt offer to be withdrawn, got %v", offers)
+	}
+	if offers := relay.dhtRecords.get(itemKey("fish")); len(offers) != 1 || offers[0].Price != 5 {
+		t.Fatalf("expected the relay to store the fish offer, got %v", offers)
+	}
+}
+
+// TestSellerSelection tests that each seller selection strategy picks the
+// seller it should out of the offers the buyer collected.
+func TestSellerSelection(t *testing.T) {
+
+	testnode, err := CreateNodeFromConfigFile([]byte(pricedSeller + "sellerselection: fewesthops\n"))
+	if err != nil {
+		t.Fatalf("Error configuring node for test rpc call: %s", err)
+		return
+	}
+
+	offers := []Offer{
+		{Seller: nodeconfig.Peer{PeerID: 5}, Price: 2, Hops: 3},
+		{Seller: nodeconfig.Peer{PeerID: 2}, Price: 4, Hops: 1},
+		{Seller: nodeconfig.Peer{PeerID: 9}, Price: 3, Hops: 2},
+	}
+	if picked := offers[testnode.selector.Select(offers)].Seller.PeerID; picked != 2 {
+		t.Fatalf("expected the fewest hops selection to pick seller 2, got %d", picked)
+	}
+
+	price, _ := newSellerSelector(nodeconfig.SelectLowestPrice, testnode.sellers, testnode.reputation)
+	if picked := offers[price.Select(offers)].Seller.PeerID; picked != 5 {
+		t.Fatalf("expected the lowest price selection to pick seller 5, got %d", picked)
+	}
+
+	// round robin goes through the sellers by node id, and wraps around
+	roundRobin, _ := newSellerSelector(nodeconfig.SelectRoundRobin, testnode.sellers, testnode.reputation)
+	for _, want := range []int{2, 5, 9, 2} {
+		if picked := offers[roundRobin.Select(offers)].Seller.PeerID; picked != want {
+			t.Fatalf("expected the round robin selection to pick seller %d, got %d", want, picked)
+		}
+	}
+
+	// seller 9 has not been bought from, so its latency is not known yet and
+	// it is tried first
+	latency, _ := newSellerSelector(nodeconfig.SelectLowestLatency, testnode.sellers, testnode.reputation)
+	testnode.sellers.record(2, 50*time.Millisecond)
+	testnode.sellers.record(5, 10*time.Millisecond)
+	if picked := offers[latency.Select(offers)].Seller.PeerID; picked != 9 {
+		t.Fatalf("expected the lowest latency selection to try seller 9 first, got %d", picked)
+	}
+	testnode.sellers.record(9, 80*time.Millisecond)
+	if picked := offers[latency.Select(offers)].Seller.PeerID; picked != 5 {
+		t.Fatalf("expected the lowest latency selection to pick seller 5, got %d", picked)
+	}
+
+	// seller 5 failed, and seller 2 and 9 delivered, but seller 9 only
+	// partially
+	reputation, _ := newSellerSelector(nodeconfig.SelectReputation, testnode.sellers, testnode.reputation)
+	testnode.reputation.rate(5, 0)
+	testnode.reputation.rate(2, 1)
+	testnode.reputation.rate(9, 0.5)
+	if picked := offers[reputation.Select(offers)].Seller.PeerID; picked != 2 {
+		t.Fatalf("expected the reputation selection to pick seller 2, got %d", picked)
+	}
+
+	// purchases are written to the purchase log with the strategy
+	var purchaselog bytes.Buffer
+	testnode.PurchaseLogger = log.New(&purchaselog, "", 0)
+	testnode.reportPurchase(offers[1], time.Second, true)
+	if line := purchaselog.String(); line != "fewesthops 1.000000 1.000000 4.000000 1\n" {
+		t.Fatalf("expected the purchase to be written to the purchase log, got %q", line)
+	}
+
+	_, err = CreateNodeFromConfigFile([]byte(pricedSeller + "sellerselection: cheapest\n"))
+	if err == nil {
+		t.Fatalf("expected an unknown seller selection to be rejected")
+	}
+}
+
+// TestReputation tests that buyers rate sellers on their sell outcomes, that
+// ratings decay and are gossiped to peers, and that replies from sellers below
+// the reputation threshold are ignored.
+func TestReputation(t *testing.T) {
+
+	peer, err := CreateNodeFromConfigFile([]byte(pricedNode(16)))
+	if err != nil {
+		t.Fatalf("Error configuring peer for test rpc call: %s", err)
+		return
+	}
+	stopChan := make(chan bool, 1)
+	doneChan := make(chan bool)
+	server := &BazaarServer{node: peer}
+	go server.ListenRPC(stopChan, doneChan)
+	<-doneChan
+	defer close(stopChan)
+
+	testnode, err := CreateNodeFromConfigFile([]byte("peers:\n  16: localhost:30016\n" + pricedSeller + "reputationthreshold: 0.4\nreputationhalflife: 20ms\n"))
+	if err != nil {
+		t.Fatalf("Error configuring node for test rpc call: %s", err)
+		return
+	}
+
+	// seller 7 filled half the order, and seller 8 failed twice. Purchases
+	// the buyer could not pay for are not rated.
+	testnode.rateSeller(7, 2, TransactionResponse{Status: StatusSold, Quantity: 1}, nil)
+	testnode.rateSeller(8, 1, TransactionResponse{}, ErrOutOfStock)
+	testnode.rateSeller(8, 1, TransactionResponse{}, ErrOutOfStock)
+	testnode.rateSeller(9, 1, TransactionResponse{Status: StatusInsufficientFunds}, ErrInsufficientFunds)
+
+	// neither are purchases that timed out or were never sent
+	testnode.rateSeller(9, 1, TransactionResponse{}, fmt.Errorf("%w: node.Sell to peer 9", ErrRPCTimeout))
+	testnode.rateSeller(9, 1, TransactionResponse{}, ErrPeerUnavailable)
+	table := testnode.reputation.table()
+	if len(table) != 2 || math.Abs(table[0].Score-0.5) > 0.01 || math.Abs(table[1].Score-0.25) > 0.01 {
+		t.Fatalf("expected scores of 0.5 for seller 7 and 0.25 for seller 8, got %v", table)
+	}
+
+	// the reply from seller 8 is ignored, and the one from seller 7 is not
+	testnode.openReplies(1)
+	for _, sellerID := range []int{7, 8} {
+		testnode.reply(ReplyArgs{RouteList: []nodeconfig.Peer{testnode.self()}, Offer: Offer{Seller: nodeconfig.Peer{PeerID: sellerID}, Item: "salt"}, LookupUUID: 1})
+	}
+	if offers := testnode.closeReplies(1); len(offers) != 1 || offers[0].Seller.PeerID != 7 || testnode.state.IgnoredReplies != 1 {
+		t.Fatalf("expected only the reply from seller 7, got %v and %d ignored replies", offers, testnode.state.IgnoredReplies)
+	}
+
+	// a threshold above the starting score still trusts sellers without
+	// ratings, but not ones that were rated at one half
+	testnode.config.ReputationThreshold = 0.6
+	if !testnode.trusts(10) || testnode.trusts(7) {
+		t.Fatalf("expected only the unrated seller to be trusted")
+	}
+	testnode.config.ReputationThreshold = 0.4
+
+	// the peer gets the ratings through gossip, at half the weight
+	testnode.gossipReputation()
+	time.Sleep(50 * time.Millisecond)
+	gossiped := peer.reputation.table()
+	if len(gossiped) != 2 || gossiped[1].Reporters != 1 || gossiped[1].Score >= 0.5 {
+		t.Fatalf("expected the peer to get the gossiped ratings, got %v", gossiped)
+	}
+	if err := PrintReputation("localhost:30016"); err != nil {
+		t.Fatalf("error printing the peer's reputation table: %s", err)
+	}
+
+	// after a few half lives, the ratings are forgotten
+	time.Sleep(300 * time.Millisecond)
+	if ratings := testnode.reputation.ratings(); len(ratings) != 0 || !testnode.trusts(8) {
+		t.Fatalf("expected the ratings to decay, got %v", ratings)
+	}
+}
+
+// TestLookupTracing tests that lookup uuids are unique across nodes, and that
+// a traced lookup and its reply record a span at every node they pass through.
+func TestLookupTracing(t *testing.T) {
+
+	seller, err := CreateNodeFromConfigFile([]byte(pricedNode(18) + "sellertarget: salt\n"))
+	if err != nil {
+		t.Fatalf("Error configuring seller for test rpc call: %s", err)
+		return
+	}
+	buyer, err := CreateNodeFromConfigFile([]byte("peers:\n  18: localhost:30018\n" + pricedNode(17) + "role: buyer\ntrace: true\n"))
+	if err != nil {
+		t.Fatalf("Error configuring buyer for test rpc call: %s", err)
+		return
+	}
+	for _, testnode := range []*BazaarNode{seller, buyer} {
+		stopChan := make(chan bool, 1)
+		doneChan := make(chan bool)
+		server := &BazaarServer{node: testnode}
+		go server.ListenRPC(stopChan, doneChan)
+		<-doneChan
+		defer close(stopChan)
+	}
+
+	if buyer.GetLookupUUID()>>32 != 17 || seller.GetLookupUUID()>>32 != 18 {
+		t.Fatalf("expected lookup uuids to start with the node id")
+	}
+
+	var export bytes.Buffer
+	buyer.TraceExport = &export
+	lookupUUID, _, sellers := buyer.search("salt", nodeconfig.LookupFilter{})
+	if len(sellers) != 1 {
+		t.Fatalf("expected a reply from the seller, got %d replies", len(sellers))
+	}
+
+	var record TraceRecord
+	err = json.Unmarshal(export.Bytes(), &record)
+	if err != nil {
+		t.Fatalf("error reading exported trace: %s", err)
+	}
+	if record.Lookup != lookupUUID || record.Buyer != 17 || record.Seller != 18 || record.Item != "salt" {
+		t.Fatalf("expected the trace of lookup %d from 17 answered by 18, got %+v", lookupUUID, record)
+	}
+
+	want := []Span{{Node: 17, Event: SpanStart}, {Node: 17, Event: SpanLookup}, {Node: 18, Event: SpanLookup}, {Node: 18, Event: SpanOffer}, {Node: 18, Event: SpanReply}, {Node: 17, Event: SpanReply}}
+	if len(record.Spans) != len(want) {
+		t.Fatalf("expected %d spans, got %s", len(want), record.Spans)
+	}
+	for i, span := range record.Spans {
+		if span.Node != want[i].Node || span.Event != want[i].Event || span.Time.Before(record.Spans[0].Time) {
+			t.Fatalf("expected span %d to be %s at %d, got %s", i, want[i].Event, want[i].Node, record.Spans)
+		}
+	}
+}
+
+// TestPeerReconnect tests that a broken connection to a peer is dropped and
+// dialed again, and that the node backs off from a peer that keeps failing.
+func TestPeerReconnect(t *testing.T) {
+
+	peer, err := CreateNodeFromConfigFile([]byte(pricedNode(19) + "sellertarget: salt\n"))
+	if err != nil {
+		t.Fatalf("Error configuring peer for test rpc call: %s", err)
+		return
+	}
+	stopChan := make(chan bool, 1)
+	doneChan := make(chan bool)
+	server := &BazaarServer{node: peer}
+	go server.ListenRPC(stopChan, doneChan)
+	<-doneChan
+	defer close(stopChan)
+
+	testnode, err := CreateNodeFromConfigFile([]byte(pricedSeller))
+	if err != nil {
+		t.Fatalf("Error configuring node for test rpc call: %s", err)
+		return
+	}
+
+	// the cached client's connection is closed, as if the peer restarted
+	conn, remote := net.Pipe()
+	testnode.peerClients[19] = rpc.NewClient(conn)
+	remote.Close()
+	time.Sleep(20 * time.Millisecond)
+
+	_, err = testnode.callSellRPC(nodeconfig.Peer{PeerID: 19, Addr: "localhost:30019"}, "", "salt", 1, 3)
+	if err != nil {
+		t.Fatalf("expected the sell call to reconnect to the peer, got %s", err)
+	}
+	if health := testnode.peerHealth[19]; health.failures != 0 {
+		t.Fatalf("expected the reconnect to reset the peer's failures, got %d", health.failures)
+	}
+
+	// calls that need a connection at the same time share a single dial
+	delete(testnode.peerClients, 19)
+	clients := make([]*rpc.Client, 5)
+	var wg sync.WaitGroup
+	for i := range clients {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			clients[i], _ = testnode.getClientForPeer(context.Background(), nodeconfig.Peer{PeerID: 19, Addr: "localhost:30019"})
+		}(i)
+	}
+	wg.Wait()
+	for _, client := range clients {
+		if client == nil || client != testnode.peerClients[19] {
+			t.Fatalf("expected every call to get the same client")
+		}
+	}
+
+	// nothing listens on the unreachable peer, so after a few failures the
+	// node stops dialing it until its backoff passes. A dial cut short by the
+	// caller's deadline does not count.
+	unreachable := nodeconfig.Peer{PeerID: 20, Addr: "localhost:30020"}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = testnode.getClientForPeer(ctx, unreachable)
+	if err == nil || testnode.peerHealth[20].failures != 0 {
+		t.Fatalf("expected the cancelled dial to fail without counting, got %v", err)
+	}
+	for i := 0; i < breakerThreshold; i++ {
+		_, err = testnode.callSellRPC(unreachable, "", "salt", 1, 3)
+		if err == nil || errors.Is(err, ErrPeerUnavailable) {
+			t.Fatalf("expected call %d to fail dialing the peer, got %v", i, err)
+		}
+	}
+	_, err = testnode.callSellRPC(unreachable, "", "salt", 1, 3)
+	if !errors.Is(err, ErrPeerUnavailable) {
+		t.Fatalf("expected the node to back off from the peer, got %v", err)
+	}
+
+	// once the backoff has passed, a probe is let through, and the backoff
+	// doubles when it fails
+	time.Sleep(minBackoff)
+	_, err = testnode.callSellRPC(unreachable, "", "salt", 1, 3)
+	if err == nil || errors.Is(err, ErrPeerUnavailable) {
+		t.Fatalf("expected the probe to fail dialing the peer, got %v", err)
+	}
+	if health := testnode.peerHealth[20]; health.failures != breakerThreshold+1 || health.backoff() != 2*minBackoff {
+		t.Fatalf("expected %d failures and a backoff of %s, got %d and %s", breakerThreshold+1, 2*minBackoff, health.failures, health.backoff())
+	}
+}
+
+// TestRPCTimeouts tests that calls to a peer that never answers time out and
+// are counted apart from the latencies, and that nodes drop lookups past their
+// deadline.
+func TestRPCTimeouts(t *testing.T) {
+
+	// the hung peer accepts connections, but never answers
+	listener, err := net.Listen("tcp", "localhost:30021")
+	if err != nil {
+		t.Fatalf("Error listening for hung peer: %s", err)
+	}
+	defer listener.Close()
+	go func() {
+		var conns []net.Conn
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conns = append(conns, conn)
+		}
+	}()
+
+	testnode, err := CreateNodeFromConfigFile([]byte(pricedSeller + "calltimeout: 50ms\nsellertarget: salt\n"))
+	if err != nil {
+		t.Fatalf("Error configuring node for test rpc call: %s", err)
+		return
+	}
+
+	start := time.Now()
+	_, err = testnode.callSellRPC(nodeconfig.Peer{PeerID: 21, Addr: "localhost:30021"}, "", "salt", 1, 3)
+	if !errors.Is(err, ErrRPCTimeout) || time.Since(start) > time.Second {
+		t.Fatalf("expected the sell call to time out, got %v after %s", err, time.Since(start))
+	}
+	if testnode.state.TimeoutCountRemote != 1 || testnode.state.RequestCountRemote != 0 {
+		t.Fatalf("expected one timeout and no latency, got %d timeouts and %d latencies", testnode.state.TimeoutCountRemote, testnode.state.RequestCountRemote)
+	}
+
+	// the deadline was the caller's, so the connection is kept and the peer
+	// is not counted as failing
+	if _, ok := testnode.peerClients[21]; !ok || testnode.peerHealth[21].failures != 0 {
+		t.Fatalf("expected the timeout to keep the connection to the peer")
+	}
+
+	// a paid sell that is never answered may have gone through, so the
+	// payment is kept and the outcome is unknown
+	_, _, err = testnode.payAndSell(nodeconfig.Peer{PeerID: 21, Addr: "localhost:30021"}, "salt", 1, 3)
+	if !errors.Is(err, ErrOutcomeUnknown) || testnode.balance() != 7 {
+		t.Fatalf("expected the outcome to be unknown and the payment kept, got %v and a balance of %d", err, testnode.balance())
+	}
+	if testnode.sellers.latency(21) != 0 {
+		t.Fatalf("expected no latency for a seller that never answered, got %f", testnode.sellers.latency(21))
+	}
+
+	// the seller does not reply to a lookup past its deadline, and the
+	// lookup is not sent on
+	replies := testnode.openReplies(1)
+	args := LookupArgs{ProductName: "salt", HopCount: 1, BuyerID: testnode.config.NodeID, Route: []nodeconfig.Peer{}, UUID: 1, deadline: time.Now().Add(-time.Millisecond)}
+	testnode.lookupProduct(args)
+	testnode.callLookupRPC(nodeconfig.Peer{PeerID: 21, Addr: "localhost:30021"}, args)
+	time.Sleep(20 * time.Millisecond)
+	if len(replies) != 0 || testnode.state.ExpiredLookups != 2 || testnode.state.LookupMessages != 0 {
+		t.Fatalf("expected the expired lookup to be dropped twice, got %d replies, %d expired lookups and %d messages", len(replies), testnode.state.ExpiredLookups, testnode.state.LookupMessages)
+	}
+
+	// a lookup cut off at its deadline is dropped, and not counted as a
+	// timeout of the peer
+	timeouts := testnode.state.TimeoutCountRemote + testnode.state.TimeoutCountLocal
+	args.UUID = 2
+	args.deadline = time.Now().Add(20 * time.Millisecond)
+	testnode.callLookupRPC(nodeconfig.Peer{PeerID: 21, Addr: "localhost:30021"}, args)
+	if testnode.state.ExpiredLookups != 3 || testnode.state.TimeoutCountRemote+testnode.state.TimeoutCountLocal != timeouts {
+		t.Fatalf("expected the lookup to be dropped at its deadline without a timeout, got %d expired lookups and %d timeouts", testnode.state.ExpiredLookups, testnode.state.TimeoutCountRemote+testnode.state.TimeoutCountLocal-timeouts)
+	}
+
+	// the node starts the lookup's budget when it receives the lookup
+	args.deadline = time.Time{}
+	args.Budget = time.Minute
+	args.received()
+	if until := time.Until(args.deadline); until <= 0 || until > time.Minute {
+		t.Fatalf("expected the deadline to be a minute away, got %s", until)
+	}
 }
 
 // firstNode wants to buy one thing - salt. max hops is 4.
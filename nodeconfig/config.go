@@ -2,7 +2,9 @@
 package nodeconfig
 
 import (
+	"fmt"
 	"sync"
+	"time"
 )
 
 // NodeConfig includes a list of peers, node role, a list of items (with
@@ -25,47 +27,491 @@ type NodeConfig struct {
 	// NodePort is the port for the node to listen on for RPC
 	NodePort int `yaml:"nodeport"`
 
-	// SellerList is a list of sellers for the buyer to choose from
-	SellerList []int `yaml:"-"`
+	// Balance is the amount of money the node starts with. Buyers spend it,
+	// and sellers are paid into it.
+	Balance int `yaml:"balance"`
+
+	// BuyerOptionList is a list of items for the buyer to choose from. Each
+	// item is either just the item name, or the item along with a lookup
+	// filter.
+	BuyerOptionList []BuyerOption `yaml:",flow"`
+
+	// BuyQuantity is how many units of an item the buyer buys at a time. The
+	// default is one.
+	BuyQuantity int `yaml:"buyquantity,omitempty"`
+
+	// SellerSelection is how the buyer picks the seller it tries to buy from
+	// first, out of the sellers that replied to its lookup. It is
+	// SelectRandom, which is the default, SelectFewestHops,
+	// SelectLowestLatency, SelectLowestPrice, SelectRoundRobin or
+	// SelectReputation.
+	SellerSelection string `yaml:"sellerselection,omitempty"`
+
+	// ReputationThreshold is the lowest reputation score, from zero to one, a
+	// seller can have for the buyer to take its replies to lookups. Sellers
+	// start at one half, and replies from sellers without ratings are always
+	// taken. Zero, the default, takes replies from every seller.
+	ReputationThreshold float64 `yaml:"reputationthreshold,omitempty"`
+
+	// ReputationGossip is how often the node sends its ratings of sellers to
+	// its peers. The node does not gossip if it is zero.
+	ReputationGossip time.Duration `yaml:"reputationgossip,omitempty"`
+
+	// ReputationHalfLife is how long it takes for a rating to count half as
+	// much toward a seller's reputation. The default is one minute.
+	ReputationHalfLife time.Duration `yaml:"reputationhalflife,omitempty"`
+
+	// Trace makes the buyer trace its lookups. Every node a traced lookup or
+	// its reply passes through adds a timestamped span to it.
+	Trace bool `yaml:"trace,omitempty"`
+
+	// Reserve makes the buyer reserve an item with the seller it picked, and
+	// commit the reservation, instead of buying the item directly.
+	Reserve bool `yaml:"reserve,omitempty"`
+
+	// ReservationLease is how long a seller holds reserved items for a buyer
+	// before the reservation expires. The default is one second.
+	ReservationLease time.Duration `yaml:"reservationlease,omitempty"`
+
+	// OfferTTL is how long the offers a seller replies to lookups with are
+	// valid for. Buyers drop offers that have expired. The default is one
+	// second.
+	OfferTTL time.Duration `yaml:"offerttl,omitempty"`
+
+	// RequestCacheSize is how many recent sell requests a seller remembers
+	// the outcome of, so retried requests are not sold twice. The default is
+	// 1024.
+	RequestCacheSize int `yaml:"requestcachesize,omitempty"`
+
+	// LookupCacheTTL is how long the node remembers a lookup it has seen, and
+	// drops the same lookup if it reaches the node again. The default is ten
+	// seconds.
+	LookupCacheTTL time.Duration `yaml:"lookupcachettl,omitempty"`
+
+	// DialTimeout is the longest the node waits to connect to a peer. The
+	// default is one second.
+	DialTimeout time.Duration `yaml:"dialtimeout,omitempty"`
+
+	// CallTimeout is the longest the node waits for a peer to answer an RPC.
+	// The default is two seconds.
+	CallTimeout time.Duration `yaml:"calltimeout,omitempty"`
+
+	// SellerMode decides which lookups the seller replies to. It is either
+	// SellerModeTarget, which is the default, or SellerModeAll.
+	SellerMode string `yaml:"sellermode,omitempty"`
+
+	// Search is how the node sends out lookups. It is either SearchFlood,
+	// which is the default, SearchRandomWalk or SearchDHT.
+	Search string `yaml:"search,omitempty"`
+
+	// Walkers is how many walkers a buyer starts for each lookup when
+	// searching with random walks. The default is four.
+	Walkers int `yaml:"walkers,omitempty"`
+
+	// DHTRepublish is how often a seller registers its items in the DHT,
+	// when the node uses the DHT search strategy. The default is ten seconds.
+	DHTRepublish time.Duration `yaml:"dhtrepublish,omitempty"`
+
+	// ReplyPolicy decides how long the buyer collects replies to a lookup. It
+	// is ReplyPolicyTimeout, which is the default, ReplyPolicyFirst,
+	// ReplyPolicyFirstN or ReplyPolicyDeadline.
+	ReplyPolicy string `yaml:"replypolicy,omitempty"`
+
+	// ReplyTimeout is the longest the buyer collects replies to a lookup.
+	// The default is 200 milliseconds.
+	ReplyTimeout time.Duration `yaml:"replytimeout,omitempty"`
+
+	// ReplyCount is how many replies the buyer waits for with the
+	// ReplyPolicyFirstN policy. The default is three.
+	ReplyCount int `yaml:"replycount,omitempty"`
+
+	// ReplyDeadline is how long the buyer searches for an item with the
+	// ReplyPolicyDeadline policy, over all the lookups of an expanding ring.
+	ReplyDeadline time.Duration `yaml:"replydeadline,omitempty"`
+
+	// DirectReply makes the seller send its replies straight to the buyer,
+	// instead of back along the lookup's route. The seller falls back to the
+	// route if it cannot reach the buyer.
+	DirectReply bool `yaml:"directreply,omitempty"`
+
+	// CancelLookups makes the buyer flood a cancel message for its lookup
+	// once it has picked a seller, so nodes stop forwarding the lookup and
+	// replies to it.
+	CancelLookups bool `yaml:"cancellookups,omitempty"`
+
+	// ExpandingRing makes the buyer send each lookup one hop at first, and
+	// send it again with one more hop every time no seller replies, up to
+	// MaxHops.
+	ExpandingRing bool `yaml:"expandingring,omitempty"`
+
+	// AdvertiseInterval is how often a seller pushes a catalog of what it is
+	// selling to the nodes around it. Sellers do not advertise if it is zero.
+	AdvertiseInterval time.Duration `yaml:"advertiseinterval,omitempty"`
+
+	// AdvertiseHops is how many hops away from the seller a catalog reaches.
+	// The default is one, which only reaches the seller's peers.
+	AdvertiseHops int `yaml:"advertisehops,omitempty"`
+
+	// AdvertiseTTL is how long nodes keep a catalog before it expires. The
+	// default is three times the advertise interval.
+	AdvertiseTTL time.Duration `yaml:"advertisettl,omitempty"`
+
+	// SellerTarget is the item that the seller is currently selling. If it is
+	// empty, or the item is not available, the seller picks an item at random
+	// when it starts.
+	SellerTarget string `yaml:"sellertarget,omitempty"`
+
+	// Snapshot is set in the configs that nodes write as snapshots. A
+	// snapshot already includes the transactions in the node's ledger, so it
+	// cannot be started with a ledger that has entries.
+	Snapshot bool `yaml:"snapshot,omitempty"`
+
+	// ReceiptCount is the number of sales the node had made when it wrote
+	// the snapshot, so a node started from the snapshot does not reuse
+	// receipt ids.
+	ReceiptCount int `yaml:"receiptcount,omitempty"`
+}
+
+// The seller modes a node can be configured with.
+const (
+	// SellerModeTarget makes the seller only reply to lookups for its seller
+	// target, and pick a new target when the current one sells out.
+	SellerModeTarget = "target"
+
+	// SellerModeAll makes the seller reply to lookups for any item it has in
+	// stock, or can restock.
+	SellerModeAll = "all"
+)
+
+// The search strategies a node can be configured with.
+const (
+	// SearchFlood sends a lookup to every neighbour that is not on the
+	// lookup's route, until the hop count runs out.
+	SearchFlood = "flood"
+
+	// SearchRandomWalk sends a number of walkers for each lookup. Every node
+	// forwards a walker to one neighbour picked at random that the walker has
+	// not visited yet, until the walker finds a seller or its hop count runs
+	// out.
+	SearchRandomWalk = "randomwalk"
+
+	// SearchDHT looks up the sellers of an item in a Kademlia style DHT
+	// formed by the nodes, under the hash of the item's name. Nodes with this
+	// strategy join the DHT, and sellers register their items in it.
+	SearchDHT = "dht"
+)
+
+// The reply policies a buyer can be configured with. Replies that arrive after
+// the buyer stops collecting them are dropped.
+const (
+	// ReplyPolicyTimeout collects replies for the full reply timeout.
+	ReplyPolicyTimeout = "timeout"
+
+	// ReplyPolicyFirst stops collecting at the first reply, or at the reply
+	// timeout.
+	ReplyPolicyFirst = "first"
+
+	// ReplyPolicyFirstN stops collecting once ReplyCount replies arrived, or
+	// at the reply timeout.
+	ReplyPolicyFirstN = "firstn"
+
+	// ReplyPolicyDeadline collects replies for the reply timeout, but stops
+	// the whole search, including the rings of an expanding ring search, at
+	// the reply deadline.
+	ReplyPolicyDeadline = "deadline"
+)
+
+// The seller selection strategies a buyer can be configured with. If the buyer
+// cannot buy everything from the seller it picked, it moves on to the next
+// seller that replied.
+const (
+	// SelectRandom picks a seller at random.
+	SelectRandom = "random"
+
+	// SelectFewestHops picks the seller that is the fewest hops away.
+	SelectFewestHops = "fewesthops"
+
+	// SelectLowestLatency picks the seller whose sell requests have been the
+	// fastest so far. Sellers the buyer has not bought from yet are tried
+	// first, so their latency is known.
+	SelectLowestLatency = "lowestlatency"
+
+	// SelectLowestPrice picks the seller with the lowest price.
+	SelectLowestPrice = "lowestprice"
+
+	// SelectRoundRobin picks the sellers in turn, by their node id.
+	SelectRoundRobin = "roundrobin"
+
+	// SelectReputation picks the seller with the best reputation.
+	SelectReputation = "reputation"
+)
 
-	// BuyerOptionList is a list of items for the buyer to choose from
-	BuyerOptionList []string `yaml:",flow"`
+// NodeState is the runtime state of a node. It is kept apart from NodeConfig
+// so that a node's config can be written back out, for example in a snapshot,
+// and loaded again.
+type NodeState struct {
+	// SellerList is a list of sellers for the buyer to choose from
+	SellerList []int
 
 	// BuyerTarget is the item that the buyer wishes to buy
-	BuyerTarget string `yaml:"-"`
+	BuyerTarget string
 
 	// Mu is the mutex lock for the current node
-	Mu *sync.Mutex `yaml:"-"`
-
-	// SellerTarget is the item that the seller is currently selling
-	SellerTarget string `yaml:"-"`
+	Mu *sync.Mutex
 
 	// Latency is the culmulative response time for all requests
-	LatencyLookup float64 `yaml:"-"`
+	LatencyLookup float64
 
 	// RequestCount is the number of RPC calls submitted by the client
-	RequestCountLookup int `yaml:"-"`
+	RequestCountLookup int
 
 	// Latency is the culmulative response time for all requests
-	LatencyRemote float64 `yaml:"-"`
+	LatencyRemote float64
 
 	// RequestCount is the number of RPC calls submitted by the client
-	RequestCountRemote int `yaml:"-"`
+	RequestCountRemote int
 
 	// Latency is the culmulative response time for all requests
-	LatencyLocal float64 `yaml:"-"`
+	LatencyLocal float64
 
 	// RequestCount is the number of RPC calls submitted by the client
-	RequestCountLocal int `yaml:"-"`
+	RequestCountLocal int
+
+	// LookupsIssued is the number of lookups the buyer has started, and
+	// LookupsAnswered is how many of them got at least one reply
+	LookupsIssued   int
+	LookupsAnswered int
+
+	// LookupMessages is the number of lookup RPCs sent by the node
+	LookupMessages int
+
+	// RingLookups is the number of expanding ring lookups that found a
+	// seller, and RingRadius is the sum of the hop counts they were found at
+	RingLookups int
+	RingRadius  int
+
+	// LatencyDirect and LatencyReverse are the cumulative times replies took
+	// to reach the buyer directly and back along the route, and
+	// RequestCountDirect and RequestCountReverse are how many replies took
+	// each path
+	LatencyDirect       float64
+	RequestCountDirect  int
+	LatencyReverse      float64
+	RequestCountReverse int
+
+	// LateReplies is the number of replies that arrived after the buyer
+	// stopped collecting replies to their lookup
+	LateReplies int
+
+	// CancelledLookups and CancelledReplies are the number of lookups and
+	// replies the node dropped because the buyer cancelled the lookup
+	CancelledLookups int
+	CancelledReplies int
+
+	// Purchases is the number of purchases the buyer has started, and
+	// PurchasesCompleted is how many of them bought the whole quantity.
+	// PurchaseLatency is the cumulative time the purchases took, and
+	// PurchasePrice is the sum of the unit prices of the sellers picked for
+	// them.
+	Purchases          int
+	PurchasesCompleted int
+	PurchaseLatency    float64
+	PurchasePrice      int
+
+	// TimeoutCountLocal and TimeoutCountRemote are the number of RPC calls to
+	// local and remote peers that timed out. Calls that time out are not
+	// counted in the latencies.
+	TimeoutCountLocal  int
+	TimeoutCountRemote int
+
+	// ExpiredLookups is the number of lookups the node dropped because they
+	// were past their deadline
+	ExpiredLookups int
+
+	// IgnoredReplies is the number of replies the buyer ignored because the
+	// seller's reputation was below the threshold
+	IgnoredReplies int
 }
 
-// ItemAmount is an item, associated amount, and an Unlimited setting. If
-// unlimited is set to true, then the amount is ignored and the item is treated
-// as unlimited.
+// ItemAmount is an item, associated amount, unit price, and an Unlimited
+// setting. If unlimited is set to true, then the amount is ignored and the item
+// is treated as unlimited. Restock overrides the Unlimited setting if it is
+// set.
 type ItemAmount struct {
-	Item      string `yaml:"item"`
-	Amount    int    `yaml:"amount"`
-	Unlimited bool   `yaml:"unlimited"`
+	Item      string         `yaml:"item"`
+	Amount    int            `yaml:"amount"`
+	Unlimited bool           `yaml:"unlimited"`
+	Price     int            `yaml:"price"`
+	Restock   *RestockPolicy `yaml:"restock,omitempty"`
+}
+
+// The restock modes an item can be configured with.
+const (
+	// RestockBatch restocks a batch of units whenever the seller does not
+	// have enough to fill an order.
+	RestockBatch = "batch"
+
+	// RestockPeriodic restocks a batch of units every interval, whether or
+	// not the item has sold out.
+	RestockPeriodic = "periodic"
+
+	// RestockNever never restocks the item.
+	RestockNever = "never"
+)
+
+// DefaultRestockBatch is the number of units restocked at a time if the
+// restock policy does not set a batch size.
+const DefaultRestockBatch = 10
+
+// RestockPolicy is how a seller restocks an item. Batch is how many units are
+// added on each restock, Interval is how often periodic restocks happen, and
+// Max caps the amount of the item a restock can bring the seller up to. A Max
+// of zero means there is no cap.
+type RestockPolicy struct {
+	Mode     string        `yaml:"mode"`
+	Batch    int           `yaml:"batch,omitempty"`
+	Interval time.Duration `yaml:"interval,omitempty"`
+	Max      int           `yaml:"max,omitempty"`
+}
+
+// RestockPolicy returns the restock policy for the item. Items without a
+// policy restock in batches of DefaultRestockBatch if they are unlimited, and
+// never restock otherwise.
+func (item ItemAmount) RestockPolicy() RestockPolicy {
+	if item.Restock != nil {
+		policy := *item.Restock
+		if policy.Batch == 0 {
+			policy.Batch = DefaultRestockBatch
+		}
+		return policy
+	}
+
+	if item.Unlimited {
+		return RestockPolicy{Mode: RestockBatch, Batch: DefaultRestockBatch}
+	}
+	return RestockPolicy{Mode: RestockNever}
+}
+
+// RestocksOnDemand returns true if the seller restocks the item whenever it
+// does not have enough, so it can always be sold.
+func (item ItemAmount) RestocksOnDemand() bool {
+	return item.RestockPolicy().Mode == RestockBatch
+}
+
+// Validate returns an error if the restock policy is not valid.
+func (policy RestockPolicy) Validate() error {
+	switch policy.Mode {
+	case RestockBatch, RestockNever:
+	case RestockPeriodic:
+		if policy.Interval <= 0 {
+			return fmt.Errorf("periodic restock needs an interval greater than zero")
+		}
+	default:
+		return fmt.Errorf("unknown restock mode %q, the restock mode must be %q, %q, or %q", policy.Mode, RestockBatch, RestockPeriodic, RestockNever)
+	}
+
+	if policy.Batch < 0 || policy.Max < 0 {
+		return fmt.Errorf("restock batch and max cannot be negative")
+	}
+
+	return nil
+}
+
+// RestockAmount returns how many units a restock of the policy adds when the
+// seller has the given amount, taking the cap into account.
+func (policy RestockPolicy) RestockAmount(amount int) int {
+	if policy.Max == 0 {
+		return policy.Batch
+	}
+
+	restock := policy.Max - amount
+	if restock > policy.Batch {
+		restock = policy.Batch
+	}
+	if restock < 0 {
+		return 0
+	}
+	return restock
+}
+
+// BuyerOption is an item the buyer may choose to buy, and the filter that
+// sellers have to pass to reply to lookups for it.
+type BuyerOption struct {
+	Item         string `yaml:"item"`
+	LookupFilter `yaml:",inline"`
+}
+
+// UnmarshalYAML reads a buyer option that is just the item name, as well as a
+// buyer option with a filter.
+func (option *BuyerOption) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var item string
+	if err := unmarshal(&item); err == nil {
+		*option = BuyerOption{Item: item}
+		return nil
+	}
+
+	type plainOption BuyerOption
+	return unmarshal((*plainOption)(option))
+}
+
+// MarshalYAML writes a buyer option without a filter as just the item name.
+func (option BuyerOption) MarshalYAML() (interface{}, error) {
+	if option.LookupFilter.IsEmpty() {
+		return option.Item, nil
+	}
+
+	type plainOption BuyerOption
+	return plainOption(option), nil
+}
+
+// LookupFilter is a set of constraints on the sellers that may reply to a
+// lookup. The zero value lets every seller reply.
+type LookupFilter struct {
+	// MaxPrice is the highest unit price the buyer will pay. Zero means there
+	// is no limit.
+	MaxPrice int `yaml:"maxprice,omitempty"`
+
+	// MinQuantity is the fewest units the seller must have available.
+	// Sellers that restock on demand always have enough.
+	MinQuantity int `yaml:"minquantity,omitempty"`
+
+	// ExcludeSellers are the ids of sellers that may not reply, and
+	// RequireSellers, if it is not empty, are the only sellers that may reply.
+	ExcludeSellers []int `yaml:"excludesellers,omitempty,flow"`
+	RequireSellers []int `yaml:"requiresellers,omitempty,flow"`
+}
+
+// IsEmpty returns true if the filter lets every seller reply.
+func (filter LookupFilter) IsEmpty() bool {
+	return filter.MaxPrice == 0 && filter.MinQuantity == 0 && len(filter.ExcludeSellers) == 0 && len(filter.RequireSellers) == 0
+}
+
+// Allows returns true if the seller with the given id may reply to the lookup
+// with the item it offers.
+func (filter LookupFilter) Allows(sellerID int, item ItemAmount) bool {
+	if filter.MaxPrice > 0 && item.Price > filter.MaxPrice {
+		return false
+	}
+
+	if item.Amount < filter.MinQuantity && !item.RestocksOnDemand() {
+		return false
+	}
+
+	for _, excluded := range filter.ExcludeSellers {
+		if sellerID == excluded {
+			return false
+		}
+	}
+
+	if len(filter.RequireSellers) == 0 {
+		return true
+	}
+	for _, required := range filter.RequireSellers {
+		if sellerID == required {
+			return true
+		}
+	}
+	return false
 }
 
 // Peer holds a peerID and an address.
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/rpc"
+	"strings"
+	"time"
+
+	"github.com/rjected/bazaar/nodeconfig"
+)
+
+// defaultDialTimeout and defaultCallTimeout are how long the node waits to
+// connect to a peer, and for a peer to answer a call, if the node config does
+// not set them.
+const (
+	defaultDialTimeout = time.Second
+	defaultCallTimeout = 2 * time.Second
+)
+
+// breakerThreshold is how many calls to a peer in a row have to fail before
+// the node stops calling it for a while.
+const breakerThreshold = 3
+
+// outcomeAttempts is how many times the node makes a call it has paid for
+// before it gives up on learning the outcome.
+const outcomeAttempts = 3
+
+// settleRounds is how many times the node asks a seller for the outcome of a
+// payment it does not know the outcome of, maxBackoff apart, before it gives
+// up on settling it.
+const settleRounds = 10
+
+// minBackoff and maxBackoff bound how long the node waits before it tries a
+// peer again once it has stopped calling it. The wait doubles with every
+// failure past the threshold.
+const (
+	minBackoff = 100 * time.Millisecond
+	maxBackoff = 10 * time.Second
+)
+
+// peerHealth is the circuit breaker for a peer. Failures is the number of
+// calls to the peer in a row that failed. Once it reaches breakerThreshold,
+// the circuit is open, and calls to the peer fail right away until retryAt.
+// After that, a single call is let through to probe the peer, and the circuit
+// closes again if it succeeds.
+type peerHealth struct {
+	failures int
+	retryAt  time.Time
+	probing  bool
+}
+
+// open returns true if calls to the peer are failing right away.
+func (health *peerHealth) open() bool {
+	return health.failures >= breakerThreshold
+}
+
+// backoff returns how long the node waits before it probes the peer again.
+func (health *peerHealth) backoff() time.Duration {
+	backoff := minBackoff
+	for i := breakerThreshold; i < health.failures && backoff < maxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > maxBackoff {
+		backoff = maxBackoff
+	}
+	return backoff
+}
+
+// peerHealthLocked returns the circuit breaker for the peer. The peer client
+// lock must be held.
+func (bnode *BazaarNode) peerHealthLocked(peerID int) *peerHealth {
+	health, ok := bnode.peerHealth[peerID]
+	if !ok {
+		health = &peerHealth{}
+		bnode.peerHealth[peerID] = health
+	}
+	return health
+}
+
+// peerFailedLocked counts a failed call or dial to the peer, and opens the
+// circuit once too many failed in a row. The peer client lock must be held.
+func (bnode *BazaarNode) peerFailedLocked(peerID int, err error) {
+	health := bnode.peerHealthLocked(peerID)
+	health.failures++
+	health.probing = false
+
+	if health.open() {
+		backoff := health.backoff()
+		health.retryAt = time.Now().Add(backoff)
+		log.Printf("Node %d stops calling peer %d for %s after %d failures in a row: %s", bnode.config.NodeID, peerID, backoff, health.failures, err)
+	}
+}
+
+// peerSucceededLocked closes the circuit for the peer. The peer client lock
+// must be held.
+func (bnode *BazaarNode) peerSucceededLocked(peerID int) {
+	health := bnode.peerHealthLocked(peerID)
+	if health.open() {
+		log.Printf("Node %d reconnected to peer %d", bnode.config.NodeID, peerID)
+	}
+	health.failures = 0
+	health.probing = false
+}
+
+// evictClient closes the client for the peer and removes it from the node's
+// client map, so the next call dials the peer again, and counts the failure.
+// The client is only removed if it is still the one in the map, since another
+// call may have replaced it already.
+func (bnode *BazaarNode) evictClient(peer nodeconfig.Peer, client *rpc.Client, err error) {
+	bnode.peerClientLock.Lock()
+	defer bnode.peerClientLock.Unlock()
+
+	if current, ok := bnode.peerClients[peer.PeerID]; ok && current == client {
+		delete(bnode.peerClients, peer.PeerID)
+		client.Close()
+		if bnode.VerboseLogging {
+			log.Printf("Node %d dropped its connection to peer %d: %s", bnode.config.NodeID, peer.PeerID, err)
+		}
+	}
+	bnode.peerFailedLocked(peer.PeerID, err)
+}
+
+// brokenConnection returns true if the error from a call means the connection
+// to the peer is broken. Errors returned by the peer's RPC method mean the
+// peer is up, and a call that ran out of time says nothing about the
+// connection, which other calls may still be using.
+func brokenConnection(err error) bool {
+	if err == rpc.ErrShutdown || err == io.EOF || err == io.ErrUnexpectedEOF {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+// peerAnswered returns true if the error from a call means the peer answered.
+func peerAnswered(err error) bool {
+	var serverErr rpc.ServerError
+	return err == nil || errors.As(err, &serverErr)
+}
+
+// lostCall returns true if the error from a call means the call may or may
+// not have reached the peer, because it ran out of time or the connection
+// broke while it was in flight.
+func lostCall(err error) bool {
+	return errors.Is(err, ErrRPCTimeout) || brokenConnection(err)
+}
+
+// settleOutcome makes a call that must not be lost, such as a sell or commit
+// the buyer has already paid for. If the call is lost, it is made again with
+// the same arguments, which the seller answers with the outcome of the first
+// call, until the peer answers. If the peer never answers, the outcome is
+// unknown, and it returns ErrOutcomeUnknown.
+func (bnode *BazaarNode) settleOutcome(peer nodeconfig.Peer, call func() error) error {
+	err := call()
+	if !lostCall(err) {
+		return err
+	}
+
+	for attempt := 1; attempt < outcomeAttempts; attempt++ {
+		time.Sleep(minBackoff << attempt)
+		err = call()
+		if answered(err) {
+			return err
+		}
+	}
+
+	return fmt.Errorf("%w: peer %d did not answer after %d attempts: %s", ErrOutcomeUnknown, peer.PeerID, outcomeAttempts, err)
+}
+
+// answered returns true if the error from a call means the peer answered,
+// including the sell errors the call turned the peer's errors into.
+func answered(err error) bool {
+	if peerAnswered(err) {
+		return true
+	}
+	for _, sellErr := range sellErrors {
+		if errors.Is(err, sellErr) {
+			return true
+		}
+	}
+	return false
+}
+
+// dialTimeout returns the longest the node waits to connect to a peer.
+func (bnode *BazaarNode) dialTimeout() time.Duration {
+	if bnode.config.DialTimeout <= 0 {
+		return defaultDialTimeout
+	}
+	return bnode.config.DialTimeout
+}
+
+// callTimeout returns the longest the node waits for a peer to answer a call.
+func (bnode *BazaarNode) callTimeout() time.Duration {
+	if bnode.config.CallTimeout <= 0 {
+		return defaultCallTimeout
+	}
+	return bnode.config.CallTimeout
+}
+
+// callerDeadline marks a call context that ends at the caller's deadline
+// rather than the node's call timeout.
+type callerDeadline struct{}
+
+// callContext returns a context that times out after the node's call timeout,
+// or at the deadline if the deadline is set and comes first.
+func (bnode *BazaarNode) callContext(deadline time.Time) (context.Context, context.CancelFunc) {
+	ctx := context.Background()
+	timeout := time.Now().Add(bnode.callTimeout())
+	if !deadline.IsZero() && deadline.Before(timeout) {
+		ctx = context.WithValue(ctx, callerDeadline{}, true)
+		timeout = deadline
+	}
+	return context.WithDeadline(ctx, timeout)
+}
+
+// callPeer calls the RPC method on the peer, and gives up with ErrRPCTimeout
+// when the context is done, or with ErrDeadlinePassed if the context ended at
+// the caller's deadline. If the connection to the peer is broken, the
+// client is dropped and the failure is counted, so the next call dials the
+// peer again. A call that times out leaves the connection alone, since the
+// deadline is the caller's and not a sign the peer failed. A call on a client
+// that was already shut down never reached the peer, so it is tried once more
+// on a new connection, which is what happens to the first call after a peer
+// restarts.
+func (bnode *BazaarNode) callPeer(ctx context.Context, peer nodeconfig.Peer, method string, args interface{}, reply interface{}) error {
+	for attempt := 0; ; attempt++ {
+		if ctx.Err() != nil {
+			return bnode.callTimedOut(ctx, peer, method)
+		}
+
+		client, err := bnode.getClientForPeer(ctx, peer)
+		if err != nil {
+			return err
+		}
+
+		call := client.Go(method, args, reply, make(chan *rpc.Call, 1))
+		select {
+		case <-call.Done:
+			err = call.Error
+		case <-ctx.Done():
+			return bnode.callTimedOut(ctx, peer, method)
+		}
+		if peerAnswered(err) {
+			bnode.peerClientLock.Lock()
+			bnode.peerSucceededLocked(peer.PeerID)
+			bnode.peerClientLock.Unlock()
+			return err
+		}
+		if !brokenConnection(err) {
+			return err
+		}
+
+		bnode.evictClient(peer, client, err)
+		if err != rpc.ErrShutdown || attempt > 0 {
+			return err
+		}
+	}
+}
+
+// callTimedOut reports a call to the peer that ran out of time, and returns
+// the error for it. A call cut off at the caller's deadline is not the peer's
+// fault, so it is not counted as a timeout.
+func (bnode *BazaarNode) callTimedOut(ctx context.Context, peer nodeconfig.Peer, method string) error {
+	if ctx.Value(callerDeadline{}) != nil {
+		return fmt.Errorf("%w: %s to peer %d: %s", ErrDeadlinePassed, method, peer.PeerID, ctx.Err())
+	}
+	bnode.reportRPCTimeout(peer.Addr)
+	return fmt.Errorf("%w: %s to peer %d: %s", ErrRPCTimeout, method, peer.PeerID, ctx.Err())
+}
+
+// reportRPCTimeout counts an RPC call that timed out, apart from the latency
+// of the calls that were answered, and logs the number of timeouts every 50
+// timeouts.
+func (bnode *BazaarNode) reportRPCTimeout(peer string) {
+	peerIP := strings.Split(peer, ":")[0]
+
+	bnode.perfLock.Lock()
+	defer bnode.perfLock.Unlock()
+
+	if peerIP == bnode.config.NodeIP {
+		bnode.state.TimeoutCountLocal++
+		if bnode.state.TimeoutCountLocal%50 == 0 {
+			log.Printf("👽👽👽 Local RPC timeouts of peer %d: %d 👽👽👽", bnode.config.NodeID, bnode.state.TimeoutCountLocal)
+		}
+	} else {
+		bnode.state.TimeoutCountRemote++
+		if bnode.state.TimeoutCountRemote%50 == 0 {
+			log.Printf("👽👽👽 Remote RPC timeouts of peer %d: %d 👽👽👽", bnode.config.NodeID, bnode.state.TimeoutCountRemote)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	"github.com/rjected/bazaar/nodeconfig"
+)
+
+// defaultReplyTimeout is how long the buyer waits for replies to a lookup if
+// the node config does not set it.
+const defaultReplyTimeout = 200 * time.Millisecond
+
+// defaultReplyCount is how many replies the buyer waits for with the first n
+// reply policy if the node config does not set it.
+const defaultReplyCount = 3
+
+// replyBuffer is how many replies to a lookup are held before the buyer
+// collects them. Replies that do not fit are counted as late.
+const replyBuffer = 100
+
+// replyTimeout returns how long the buyer waits for replies to a lookup.
+func (bnode *BazaarNode) replyTimeout() time.Duration {
+	if bnode.config.ReplyTimeout <= 0 {
+		return defaultReplyTimeout
+	}
+	return bnode.config.ReplyTimeout
+}
+
+// replyCount returns how many replies the buyer waits for before it stops
+// collecting, or zero if it waits for the full timeout.
+func (bnode *BazaarNode) replyCount() int {
+	switch bnode.config.ReplyPolicy {
+	case nodeconfig.ReplyPolicyFirst:
+		return 1
+	case nodeconfig.ReplyPolicyFirstN:
+		if bnode.config.ReplyCount <= 0 {
+			return defaultReplyCount
+		}
+		return bnode.config.ReplyCount
+	default:
+		return 0
+	}
+}
+
+// openReplies creates the channel that replies to the lookup are delivered
+// to, until the buyer closes it.
+func (bnode *BazaarNode) openReplies(uuid int64) chan Offer {
+	replies := make(chan Offer, replyBuffer)
+
+	bnode.replyLock.Lock()
+	bnode.replies[uuid] = replies
+	bnode.replyLock.Unlock()
+
+	return replies
+}
+
+// closeReplies stops delivering replies to the lookup, and returns the
+// replies that were delivered but not collected yet.
+func (bnode *BazaarNode) closeReplies(uuid int64) []Offer {
+	bnode.replyLock.Lock()
+	replies := bnode.replies[uuid]
+	delete(bnode.replies, uuid)
+	bnode.replyLock.Unlock()
+
+	var offers []Offer
+	for len(replies) > 0 {
+		offers = append(offers, <-replies)
+	}
+	return offers
+}
+
+// deliverReply hands the offer to the buyer's lookup. Replies to lookups the
+// buyer is no longer collecting replies for are dropped and counted.
+func (bnode *BazaarNode) deliverReply(uuid int64, offer Offer) {
+	bnode.replyLock.Lock()
+	replies, ok := bnode.replies[uuid]
+	if ok {
+		select {
+		case replies <- offer:
+		default:
+			ok = false
+		}
+	}
+	bnode.replyLock.Unlock()
+
+	if !ok {
+		bnode.countLateReply(uuid, offer)
+	}
+}
+
+// collectReplies collects replies to the lookup until the given time, or
+// until want replies arrived if want is not zero. It then closes the lookup's
+// replies, and returns true if it stopped before the given time.
+func (bnode *BazaarNode) collectReplies(uuid int64, replies chan Offer, until time.Time, want int) ([]Offer, bool) {
+	timer := time.NewTimer(time.Until(until))
+	defer timer.Stop()
+
+	var offers []Offer
+	for want == 0 || len(offers) < want {
+		select {
+		case offer := <-replies:
+			offers = append(offers, offer)
+			continue
+		case <-timer.C:
+		}
+		return append(offers, bnode.closeReplies(uuid)...), false
+	}
+
+	return append(offers, bnode.closeReplies(uuid)...), true
+}
+
+// countLateReply counts a reply that arrived after the buyer stopped
+// collecting replies to its lookup, and logs the total every 100 replies.
+func (bnode *BazaarNode) countLateReply(uuid int64, offer Offer) {
+	if bnode.VerboseLogging {
+		log.Printf("Node %d is dropping late reply from seller node %d to lookup %d", bnode.config.NodeID, offer.Seller.PeerID, uuid)
+	}
+
+	bnode.perfLock.Lock()
+	defer bnode.perfLock.Unlock()
+
+	bnode.state.LateReplies++
+	if bnode.state.LateReplies%100 == 0 {
+		log.Printf("Node %d has dropped %d late replies", bnode.config.NodeID, bnode.state.LateReplies)
+	}
+}
@@ -0,0 +1,354 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/rpc"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/rjected/bazaar/nodeconfig"
+)
+
+// defaultReputationHalfLife is how long it takes for a rating to count half as
+// much if the node config does not set it.
+const defaultReputationHalfLife = time.Minute
+
+// gossipWeight is how much the ratings a peer gossiped count toward a
+// seller's reputation, compared to the node's own ratings.
+const gossipWeight = 0.5
+
+// minRatingWeight is the weight below which a decayed rating is forgotten.
+const minRatingWeight = 0.01
+
+// SellerRating is a node's rating of a seller. Good and Bad are how many
+// purchases the seller delivered and failed to deliver, where a partially
+// filled purchase counts toward both, and older purchases count for less.
+type SellerRating struct {
+	Seller int
+	Good   float64
+	Bad    float64
+}
+
+// ReputationGossipArgs contains the RPC arguments for gossip reputation, which
+// are the node's own ratings of the sellers it has bought from.
+type ReputationGossipArgs struct {
+	From    int
+	Ratings []SellerRating
+}
+
+// ReputationGossipResponse is empty because no response is required for
+// gossip reputation.
+type ReputationGossipResponse struct {
+}
+
+// GossipReputation runs the gossip reputation command, which replaces the
+// ratings the node has from the peer with the ones it sent.
+func (bnode *BazaarNode) GossipReputation(args ReputationGossipArgs, reply *ReputationGossipResponse) error {
+	bnode.reputation.receive(args.From, args.Ratings)
+	return nil
+}
+
+// ReputationArgs is empty because no arguments are required for reputation.
+type ReputationArgs struct {
+}
+
+// ReputationResponse contains the node's reputation table, sorted by seller.
+type ReputationResponse struct {
+	Scores []ReputationScore
+}
+
+// ReputationScore is a seller's entry in a node's reputation table. Score is
+// the seller's reputation, from zero to one. Own is the node's own rating of
+// the seller, and Gossip is the sum of the ratings its peers gossiped, from
+// Reporters peers.
+type ReputationScore struct {
+	Seller    int
+	Score     float64
+	Own       SellerRating
+	Gossip    SellerRating
+	Reporters int
+}
+
+// Reputation runs the reputation command, which returns the node's reputation
+// table.
+func (bnode *BazaarNode) Reputation(args ReputationArgs, reply *ReputationResponse) error {
+	*reply = ReputationResponse{Scores: bnode.reputation.table()}
+	return nil
+}
+
+// rating is a decaying rating, as of when it was last updated.
+type rating struct {
+	good    float64
+	bad     float64
+	updated time.Time
+}
+
+// decayed returns the rating as of now.
+func (r rating) decayed(now time.Time, halfLife time.Duration) rating {
+	factor := math.Pow(0.5, now.Sub(r.updated).Seconds()/halfLife.Seconds())
+	return rating{good: r.good * factor, bad: r.bad * factor, updated: now}
+}
+
+// forgotten returns true if the rating has decayed so far that it no longer
+// counts.
+func (r rating) forgotten() bool {
+	return r.good+r.bad < minRatingWeight
+}
+
+// reputationTable holds the node's own ratings of sellers, and the ratings its
+// peers gossiped. Only the node's own ratings are gossiped on, so a rating is
+// never counted twice by coming back around. This is thread safe.
+type reputationTable struct {
+	halfLife time.Duration
+	own      map[int]rating
+
+	// gossip is a map from a peer to the ratings it gossiped, by seller
+	gossip map[int]map[int]rating
+	lock   *sync.Mutex
+}
+
+// newReputationTable creates an empty reputation table whose ratings decay
+// with the given half life.
+func newReputationTable(halfLife time.Duration) *reputationTable {
+	if halfLife <= 0 {
+		halfLife = defaultReputationHalfLife
+	}
+	return &reputationTable{
+		halfLife: halfLife,
+		own:      make(map[int]rating),
+		gossip:   make(map[int]map[int]rating),
+		lock:     &sync.Mutex{},
+	}
+}
+
+// rate adds a purchase from the seller to the node's own rating of it.
+// Delivered is the share of the purchase the seller delivered, from zero to
+// one.
+func (table *reputationTable) rate(sellerID int, delivered float64) {
+	now := time.Now()
+
+	table.lock.Lock()
+	defer table.lock.Unlock()
+
+	current := table.own[sellerID].decayed(now, table.halfLife)
+	current.good += delivered
+	current.bad += 1 - delivered
+	table.own[sellerID] = current
+}
+
+// receive replaces the ratings from the peer with the given ones.
+func (table *reputationTable) receive(peerID int, ratings []SellerRating) {
+	now := time.Now()
+
+	received := make(map[int]rating, len(ratings))
+	for _, sellerRating := range ratings {
+		received[sellerRating.Seller] = rating{good: sellerRating.Good, bad: sellerRating.Bad, updated: now}
+	}
+
+	table.lock.Lock()
+	table.gossip[peerID] = received
+	table.lock.Unlock()
+}
+
+// ratings returns the node's own ratings of sellers as of now, and forgets the
+// ones that no longer count.
+func (table *reputationTable) ratings() []SellerRating {
+	now := time.Now()
+
+	table.lock.Lock()
+	defer table.lock.Unlock()
+
+	var ratings []SellerRating
+	for sellerID, own := range table.own {
+		current := own.decayed(now, table.halfLife)
+		if current.forgotten() {
+			delete(table.own, sellerID)
+			continue
+		}
+		ratings = append(ratings, SellerRating{Seller: sellerID, Good: current.good, Bad: current.bad})
+	}
+
+	return ratings
+}
+
+// score returns the seller's reputation.
+func (table *reputationTable) score(sellerID int) float64 {
+	table.lock.Lock()
+	defer table.lock.Unlock()
+
+	return table.entry(sellerID, time.Now()).Score
+}
+
+// rated returns true if the node or its peers have a rating of the seller that
+// still counts.
+func (table *reputationTable) rated(sellerID int) bool {
+	table.lock.Lock()
+	defer table.lock.Unlock()
+
+	entry := table.entry(sellerID, time.Now())
+	return !rating{good: entry.Own.Good + entry.Gossip.Good, bad: entry.Own.Bad + entry.Gossip.Bad}.forgotten()
+}
+
+// table returns an entry for every seller the node has a rating of, sorted by
+// seller.
+func (table *reputationTable) table() []ReputationScore {
+	now := time.Now()
+
+	table.lock.Lock()
+	defer table.lock.Unlock()
+
+	sellers := make(map[int]bool)
+	for sellerID := range table.own {
+		sellers[sellerID] = true
+	}
+	for _, ratings := range table.gossip {
+		for sellerID := range ratings {
+			sellers[sellerID] = true
+		}
+	}
+
+	var scores []ReputationScore
+	for sellerID := range sellers {
+		scores = append(scores, table.entry(sellerID, now))
+	}
+	sort.Slice(scores, func(i, j int) bool {
+		return scores[i].Seller < scores[j].Seller
+	})
+
+	return scores
+}
+
+// entry returns the seller's entry in the reputation table as of now. The
+// score counts one good and one bad purchase up front, so a seller without
+// ratings starts at one half. The table lock must be held.
+func (table *reputationTable) entry(sellerID int, now time.Time) ReputationScore {
+	own := table.own[sellerID].decayed(now, table.halfLife)
+	score := ReputationScore{
+		Seller: sellerID,
+		Own:    SellerRating{Seller: sellerID, Good: own.good, Bad: own.bad},
+		Gossip: SellerRating{Seller: sellerID},
+	}
+
+	for _, ratings := range table.gossip {
+		gossiped, ok := ratings[sellerID]
+		if !ok {
+			continue
+		}
+		gossiped = gossiped.decayed(now, table.halfLife)
+		score.Gossip.Good += gossiped.good
+		score.Gossip.Bad += gossiped.bad
+		score.Reporters++
+	}
+
+	good := own.good + gossipWeight*score.Gossip.Good
+	bad := own.bad + gossipWeight*score.Gossip.Bad
+	score.Score = (good + 1) / (good + bad + 2)
+
+	return score
+}
+
+// trusts returns true if the seller's reputation is at least the node's
+// reputation threshold. Sellers without ratings are given the benefit of the
+// doubt, since a threshold above their starting score would otherwise never
+// let the buyer rate them.
+func (bnode *BazaarNode) trusts(sellerID int) bool {
+	if bnode.config.ReputationThreshold <= 0 || !bnode.reputation.rated(sellerID) {
+		return true
+	}
+	return bnode.reputation.score(sellerID) >= bnode.config.ReputationThreshold
+}
+
+// rateSeller rates the seller on the outcome of a purchase of quantity units,
+// which is the number of units the buyer paid for rather than the number it
+// wanted. Purchases the buyer could not pay for are not the seller's fault,
+// and purchases that timed out, were not sent because the buyer is backing off
+// from the seller, or whose outcome the buyer does not know say nothing about
+// the seller, so they are not rated.
+func (bnode *BazaarNode) rateSeller(sellerID int, quantity int, res TransactionResponse, err error) {
+	if quantity < 1 || res.Status == StatusInsufficientFunds || errors.Is(err, ErrInsufficientFunds) {
+		return
+	}
+	if errors.Is(err, ErrRPCTimeout) || errors.Is(err, ErrPeerUnavailable) || errors.Is(err, ErrOutcomeUnknown) {
+		return
+	}
+
+	var delivered float64
+	if err == nil && res.Status.Succeeded() {
+		delivered = math.Min(float64(res.Quantity)/float64(quantity), 1)
+	}
+	bnode.reputation.rate(sellerID, delivered)
+}
+
+// reputationLoop gossips the node's ratings of sellers to its peers every
+// gossip interval. It is meant to be run in a goroutine, and runs for as long
+// as the node does.
+func (bnode *BazaarNode) reputationLoop() {
+	ticker := time.NewTicker(bnode.config.ReputationGossip)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		bnode.gossipReputation()
+	}
+}
+
+// gossipReputation sends the node's own ratings of sellers to its peers.
+func (bnode *BazaarNode) gossipReputation() {
+	ratings := bnode.reputation.ratings()
+	if len(ratings) == 0 {
+		return
+	}
+
+	if bnode.VerboseLogging {
+		log.Printf("Node %d gossiping ratings of %d sellers", bnode.config.NodeID, len(ratings))
+	}
+
+	args := ReputationGossipArgs{From: bnode.config.NodeID, Ratings: ratings}
+	for peer, addr := range bnode.config.Peers {
+		go bnode.callGossipReputationRPC(nodeconfig.Peer{PeerID: peer, Addr: addr}, args)
+	}
+}
+
+// countIgnoredReply counts a reply the buyer ignored because the seller's
+// reputation is below the threshold, and logs the total every 100 replies.
+func (bnode *BazaarNode) countIgnoredReply(uuid int64, offer Offer) {
+	if bnode.VerboseLogging {
+		log.Printf("Node %d is ignoring reply from seller node %d to lookup %d, its reputation is below %f", bnode.config.NodeID, offer.Seller.PeerID, uuid, bnode.config.ReputationThreshold)
+	}
+
+	bnode.perfLock.Lock()
+	defer bnode.perfLock.Unlock()
+
+	bnode.state.IgnoredReplies++
+	if bnode.state.IgnoredReplies%100 == 0 {
+		log.Printf("⭐⭐⭐ Node %d has ignored %d replies from sellers with a low reputation ⭐⭐⭐", bnode.config.NodeID, bnode.state.IgnoredReplies)
+	}
+}
+
+// PrintReputation prints the reputation table of the node at the address.
+func PrintReputation(addr string) error {
+	client, err := rpc.Dial("tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	var res ReputationResponse
+	err = client.Call("node.Reputation", ReputationArgs{}, &res)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%-8s %-8s %-16s %-16s %s\n", "seller", "score", "own good/bad", "gossip good/bad", "reporters")
+	for _, score := range res.Scores {
+		fmt.Printf("%-8d %-8.3f %-16s %-16s %d\n", score.Seller, score.Score,
+			fmt.Sprintf("%.2f/%.2f", score.Own.Good, score.Own.Bad),
+			fmt.Sprintf("%.2f/%.2f", score.Gossip.Good, score.Gossip.Bad),
+			score.Reporters)
+	}
+
+	return nil
+}
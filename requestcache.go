@@ -0,0 +1,59 @@
+package main
+
+// defaultRequestCacheSize is the number of recent sell requests a seller
+// remembers if the node config does not set a size.
+const defaultRequestCacheSize = 1024
+
+// requestKey identifies a request made by a buyer.
+type requestKey struct {
+	buyerID   int
+	requestID string
+}
+
+// requestCache is a bounded table of the outcomes of recent requests. Once it
+// is full, the oldest request is forgotten to make room for a new one. It is
+// not thread safe.
+type requestCache struct {
+	outcomes map[requestKey]TransactionResponse
+
+	// order is a ring buffer of the keys in the order they were added, and
+	// next is the index of the oldest key once the ring is full.
+	order []requestKey
+	next  int
+}
+
+// newRequestCache creates a request cache which holds at most capacity
+// requests.
+func newRequestCache(capacity int) *requestCache {
+	if capacity < 1 {
+		capacity = defaultRequestCacheSize
+	}
+	return &requestCache{
+		outcomes: make(map[requestKey]TransactionResponse),
+		order:    make([]requestKey, 0, capacity),
+	}
+}
+
+// get returns the outcome of the request, if it is still in the cache.
+func (cache *requestCache) get(key requestKey) (TransactionResponse, bool) {
+	res, ok := cache.outcomes[key]
+	return res, ok
+}
+
+// put adds the outcome of the request to the cache, evicting the oldest
+// request if the cache is full.
+func (cache *requestCache) put(key requestKey, res TransactionResponse) {
+	if _, ok := cache.outcomes[key]; ok {
+		cache.outcomes[key] = res
+		return
+	}
+
+	if len(cache.order) < cap(cache.order) {
+		cache.order = append(cache.order, key)
+	} else {
+		delete(cache.outcomes, cache.order[cache.next])
+		cache.order[cache.next] = key
+		cache.next = (cache.next + 1) % len(cache.order)
+	}
+	cache.outcomes[key] = res
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/rjected/bazaar/nodeconfig"
+)
+
+// defaultReservationLease is how long a seller holds reserved items if the
+// node config does not set a lease.
+const defaultReservationLease = time.Second
+
+// reservation is a quantity of an item that a seller has taken out of its
+// stock and is holding for a buyer. If the buyer does not commit the
+// reservation before the timer fires, the items are put back into stock.
+type reservation struct {
+	id       string
+	item     string
+	buyerID  int
+	quantity int
+
+	// status is the status returned by takeStock when the item was reserved,
+	// so the commit can report whether the item had to be restocked.
+	status TransactionStatus
+
+	// price is the unit price when the item was reserved, which the buyer
+	// pays on commit even if the seller changes its price in the meantime.
+	price int
+	timer *time.Timer
+}
+
+// ReserveArgs contains the RPC arguments for reserve, which is the item the
+// buyer wants to hold, the id of the buyer, and how many units the buyer wants.
+// A Quantity of zero is treated as one.
+type ReserveArgs struct {
+	Item     string
+	BuyerID  int
+	Quantity int
+}
+
+// ReserveResponse contains the outcome of a reservation. If Status is
+// StatusReserved, Quantity units are held until Expires under the id
+// ReservationID, and Price is the unit price the buyer has to pay on commit.
+// Quantity may be less than requested if the seller did not have enough.
+type ReserveResponse struct {
+	Status        TransactionStatus
+	ReservationID string
+	Quantity      int
+	Price         int
+	Expires       time.Time
+}
+
+// CommitArgs contains the RPC arguments for commit and abort, which is the
+// reservation id, the id of the buyer that made the reservation, and the
+// payment for the reserved item. Abort ignores the payment.
+type CommitArgs struct {
+	ReservationID string
+	BuyerID       int
+	Payment       int
+}
+
+// AbortResponse is empty because no response is required for abort.
+type AbortResponse struct {
+}
+
+// Reserve runs the reserve command
+func (bnode *BazaarNode) Reserve(args ReserveArgs, reply *ReserveResponse) error {
+	if bnode.VerboseLogging {
+		log.Printf("Seller node %d reserving item %s for %d", bnode.config.NodeID, args.Item, args.BuyerID)
+	}
+
+	res, err := bnode.reserve(args.Item, args.BuyerID, args.Quantity)
+	*reply = res
+	return err
+}
+
+// Commit runs the commit command, turning a reservation into a sale.
+func (bnode *BazaarNode) Commit(args CommitArgs, reply *TransactionResponse) error {
+	*reply = bnode.commit(args.ReservationID, args.BuyerID, args.Payment)
+	return nil
+}
+
+// Abort runs the abort command, putting reserved items back into stock.
+func (bnode *BazaarNode) Abort(args CommitArgs, reply *AbortResponse) error {
+	bnode.abort(args.ReservationID, args.BuyerID)
+	return nil
+}
+
+// reservationLease returns the lease for reservations made with this node.
+func (bnode *BazaarNode) reservationLease() time.Duration {
+	if bnode.config.ReservationLease <= 0 {
+		return defaultReservationLease
+	}
+	return bnode.config.ReservationLease
+}
+
+// reserve takes up to quantity units of the target item out of stock and holds
+// them for the buyer until the lease runs out. Only sellers can reserve items.
+func (bnode *BazaarNode) reserve(target string, buyerID int, quantity int) (ReserveResponse, error) {
+
+	if bnode.config.Role != "seller" && bnode.config.Role != "both" {
+		return ReserveResponse{}, fmt.Errorf("%w: node %d is a %s", ErrNotSeller, bnode.config.NodeID, bnode.config.Role)
+	}
+
+	if quantity < 1 {
+		quantity = 1
+	}
+
+	bnode.state.Mu.Lock()
+	defer bnode.state.Mu.Unlock()
+
+	targetID := bnode.findItem(target)
+	if targetID == -1 {
+		return ReserveResponse{Status: StatusUnknownItem}, nil
+	}
+
+	filled, status := bnode.takeStock(targetID, quantity)
+	if !status.Succeeded() {
+		return ReserveResponse{Status: status}, nil
+	}
+
+	bnode.reservationCount++
+	id := fmt.Sprintf("%d-%d-r%d", bnode.config.NodeID, buyerID, bnode.reservationCount)
+	lease := bnode.reservationLease()
+	bnode.reservations[id] = &reservation{
+		id:       id,
+		item:     target,
+		buyerID:  buyerID,
+		quantity: filled,
+		status:   status,
+		price:    bnode.config.Items[targetID].Price,
+		timer: time.AfterFunc(lease, func() {
+			bnode.expireReservation(id)
+		}),
+	}
+
+	if bnode.VerboseLogging {
+		log.Printf("Seller node %d reserved %d %s for %d as %s", bnode.config.NodeID, filled, target, buyerID, id)
+	}
+
+	return ReserveResponse{
+		Status:        StatusReserved,
+		ReservationID: id,
+		Quantity:      filled,
+		Price:         bnode.config.Items[targetID].Price,
+		Expires:       time.Now().Add(lease),
+	}, nil
+}
+
+// popReservation removes the reservation with the given id from the map and
+// stops its timer. It returns nil if there is no such reservation for the
+// buyer. The caller must hold the node lock.
+func (bnode *BazaarNode) popReservation(id string, buyerID int) *reservation {
+	res, ok := bnode.reservations[id]
+	if !ok || res.buyerID != buyerID {
+		return nil
+	}
+
+	res.timer.Stop()
+	delete(bnode.reservations, id)
+	return res
+}
+
+// releaseReservation puts the reserved items back into stock. The caller must
+// hold the node lock.
+func (bnode *BazaarNode) releaseReservation(res *reservation) {
+	targetID := bnode.findItem(res.item)
+	bnode.config.Items[targetID].Amount += res.quantity
+
+	if bnode.VerboseLogging {
+		log.Printf("Seller node %d released reservation %s for %s", bnode.config.NodeID, res.id, res.item)
+	}
+}
+
+// commit turns the reservation into a sale of as many reserved units as the
+// payment covers at the reserved price, and puts the rest back into stock. If
+// the payment does not cover a single unit, the whole reservation is released.
+// A repeated commit of the same reservation is answered with the outcome of the
+// first one.
+func (bnode *BazaarNode) commit(id string, buyerID int, payment int) TransactionResponse {
+
+	bnode.state.Mu.Lock()
+	defer bnode.state.Mu.Unlock()
+
+	key := requestKey{buyerID: buyerID, requestID: id}
+	if outcome, ok := bnode.recentCommits.get(key); ok {
+		log.Printf("Seller node %d answering repeated commit of reservation %s from %d with its original outcome", bnode.config.NodeID, id, buyerID)
+		return outcome
+	}
+
+	res := bnode.popReservation(id, buyerID)
+	if res == nil {
+		return TransactionResponse{Status: StatusNoReservation}
+	}
+
+	if payment < res.price {
+		bnode.releaseReservation(res)
+		bnode.recentCommits.put(key, TransactionResponse{Status: StatusInsufficientFunds})
+		return TransactionResponse{Status: StatusInsufficientFunds}
+	}
+
+	// the units the payment does not cover go back into stock
+	targetID := bnode.findItem(res.item)
+	if res.price > 0 && payment/res.price < res.quantity {
+		bnode.config.Items[targetID].Amount += res.quantity - payment/res.price
+		res.quantity = payment / res.price
+	}
+
+	total := res.price * res.quantity
+	bnode.deposit(total)
+
+	log.Printf("💰💰💰 Node %d sold %d %s to %d for %d, amount remaining %d 💰💰💰", bnode.config.NodeID, res.quantity, res.item, buyerID, total, bnode.config.Items[targetID].Amount)
+
+	sale := TransactionResponse{
+		Status:    res.status,
+		Quantity:  res.quantity,
+		Remaining: bnode.config.Items[targetID].Amount,
+		Price:     total,
+		ReceiptID: bnode.nextReceiptID(buyerID),
+	}
+	bnode.record(LedgerEntry{Kind: LedgerSale, Item: res.item, Quantity: res.quantity, Price: total, Counterparty: buyerID, ReceiptID: sale.ReceiptID})
+	bnode.recentCommits.put(key, sale)
+
+	return sale
+}
+
+// abort releases the reservation, if it still exists.
+func (bnode *BazaarNode) abort(id string, buyerID int) {
+
+	bnode.state.Mu.Lock()
+	defer bnode.state.Mu.Unlock()
+
+	res := bnode.popReservation(id, buyerID)
+	if res != nil {
+		bnode.releaseReservation(res)
+	}
+}
+
+// expireReservation is called when the lease on a reservation runs out, and
+// releases the reservation if the buyer has not committed or aborted it yet.
+func (bnode *BazaarNode) expireReservation(id string) {
+
+	bnode.state.Mu.Lock()
+	defer bnode.state.Mu.Unlock()
+
+	res, ok := bnode.reservations[id]
+	if !ok {
+		return
+	}
+
+	delete(bnode.reservations, id)
+	log.Printf("Seller node %d reservation %s for %d expired", bnode.config.NodeID, id, res.buyerID)
+	bnode.releaseReservation(res)
+}
+
+// reserveAndCommit reserves quantity units of the target item with the seller
+// and then pays for and commits the reservation. It returns the outcome of the
+// reservation if the item could not be reserved. If the buyer cannot afford
+// all the reserved units, it only pays for and commits the ones it can afford,
+// and the seller puts the rest back into stock. If it cannot afford a single
+// unit, it aborts the reservation. It returns an error if the seller could
+// not be reached, in which case the payment is refunded, or ErrOutcomeUnknown
+// if the seller never answered the commit, in which case the payment is held
+// as pending. It also returns the number of units the buyer ordered.
+func (bnode *BazaarNode) reserveAndCommit(seller nodeconfig.Peer, target string, quantity int) (TransactionResponse, int, error) {
+
+	reserved, err := bnode.callReserveRPC(seller, target, quantity)
+	if err != nil {
+		return TransactionResponse{}, quantity, err
+	}
+	if reserved.Status != StatusReserved {
+		return TransactionResponse{Status: reserved.Status}, quantity, nil
+	}
+
+	payment := bnode.withdrawUpTo(reserved.Price * reserved.Quantity)
+	if payment < reserved.Price {
+		bnode.deposit(payment)
+		bnode.callAbortRPC(seller, reserved.ReservationID)
+		return TransactionResponse{Status: StatusInsufficientFunds}, 0, nil
+	}
+	ordered := reserved.Quantity
+	if reserved.Price > 0 {
+		ordered = payment / reserved.Price
+	}
+
+	var res TransactionResponse
+	sent := time.Now()
+	err = bnode.settleOutcome(seller, func() error {
+		var err error
+		res, err = bnode.callCommitRPC(seller, reserved.ReservationID, payment)
+		return err
+	})
+	bnode.recordSellerLatency(seller, sent, err)
+	if errors.Is(err, ErrOutcomeUnknown) {
+		pending := LedgerEntry{Item: target, Quantity: ordered, Price: payment, Counterparty: seller.PeerID, Request: reserved.ReservationID}
+		bnode.holdPayment(seller, pending, func() (TransactionResponse, error) {
+			return bnode.callCommitRPC(seller, reserved.ReservationID, payment)
+		})
+		return TransactionResponse{}, ordered, err
+	}
+	if err != nil {
+		bnode.deposit(payment)
+		return TransactionResponse{}, ordered, err
+	}
+	bnode.deposit(payment - res.Price)
+
+	return res, ordered, nil
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	"github.com/rjected/bazaar/nodeconfig"
+)
+
+// startRestocking starts a restock loop for every item with a periodic restock
+// policy.
+func (bnode *BazaarNode) startRestocking() {
+	for itemID, item := range bnode.config.Items {
+		policy := item.RestockPolicy()
+		if policy.Mode == nodeconfig.RestockPeriodic {
+			go bnode.restockLoop(itemID, policy.Interval)
+		}
+	}
+}
+
+// restockLoop restocks the item at index itemID every interval. It is meant to
+// be run in a goroutine, and runs for as long as the node does.
+func (bnode *BazaarNode) restockLoop(itemID int, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		bnode.restockPeriodic(itemID)
+	}
+}
+
+// restockPeriodic restocks a batch of the item at index itemID, up to the cap
+// of its restock policy. If the seller ran out of its seller target, it picks a
+// new one, which may be the restocked item. The catalog is invalidated if the
+// item was sold out or the seller target changed, so other nodes learn of the
+// new stock.
+func (bnode *BazaarNode) restockPeriodic(itemID int) {
+
+	bnode.state.Mu.Lock()
+	defer bnode.state.Mu.Unlock()
+
+	policy := bnode.config.Items[itemID].RestockPolicy()
+	restock := policy.RestockAmount(bnode.config.Items[itemID].Amount)
+	if restock == 0 {
+		return
+	}
+	changed := bnode.config.Items[itemID].Amount == 0
+	bnode.restock(itemID, restock)
+
+	if !bnode.sellerTargetAvailable() {
+		err := bnode.pickSellerTarget()
+		if err != nil {
+			log.Printf("Seller node %d could not pick a seller target after restocking: %s", bnode.config.NodeID, err)
+		} else {
+			log.Printf("Seller node %d now selling %s", bnode.config.NodeID, bnode.config.SellerTarget)
+			changed = true
+		}
+	}
+
+	if changed {
+		bnode.invalidateCatalog()
+	}
+}
+
+// restock adds the amount to the stock of the item at index itemID, and
+// records it in the ledger. The caller must hold the node lock.
+func (bnode *BazaarNode) restock(itemID int, amount int) {
+	bnode.config.Items[itemID].Amount += amount
+	bnode.record(LedgerEntry{Kind: LedgerRestock, Item: bnode.config.Items[itemID].Item, Quantity: amount})
+	if bnode.VerboseLogging {
+		log.Printf("Seller node %d restocked %d %s", bnode.config.NodeID, amount, bnode.config.Items[itemID].Item)
+	}
+}
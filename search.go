@@ -0,0 +1,231 @@
+package main
+
+import (
+	"log"
+	"math/rand"
+	"time"
+
+	"github.com/rjected/bazaar/nodeconfig"
+)
+
+// defaultWalkers is how many walkers a buyer starts for a random walk lookup
+// if the node config does not set it.
+const defaultWalkers = 4
+
+// defaultOfferTTL is how long a seller's offer is valid for if the node config
+// does not set it.
+const defaultOfferTTL = time.Second
+
+// offerTTL returns how long the offers the seller replies with are valid for.
+func (bnode *BazaarNode) offerTTL() time.Duration {
+	if bnode.config.OfferTTL <= 0 {
+		return defaultOfferTTL
+	}
+	return bnode.config.OfferTTL
+}
+
+// walkers returns the number of walkers the buyer starts for each random walk
+// lookup.
+func (bnode *BazaarNode) walkers() int {
+	if bnode.config.Walkers <= 0 {
+		return defaultWalkers
+	}
+	return bnode.config.Walkers
+}
+
+// searchStrategy returns the search strategy the node starts lookups with.
+func (bnode *BazaarNode) searchStrategy() string {
+	if bnode.config.Search == "" {
+		return nodeconfig.SearchFlood
+	}
+	return bnode.config.Search
+}
+
+// startLookup sends out the buyer's lookup with the node's search strategy. A
+// random walk lookup starts all of its walkers at the buyer, which sends each
+// of them on to a neighbour picked at random. A DHT lookup ignores the hop
+// count.
+func (bnode *BazaarNode) startLookup(args LookupArgs) {
+	args.Search = bnode.searchStrategy()
+	switch args.Search {
+	case nodeconfig.SearchRandomWalk:
+		for walker := 1; walker <= bnode.walkers(); walker++ {
+			args.Walker = walker
+			go bnode.lookupProduct(args)
+		}
+	case nodeconfig.SearchDHT:
+		bnode.dhtLookup(args)
+	default:
+		bnode.lookupProduct(args)
+	}
+}
+
+// search looks up the target, collects replies from sellers that pass the
+// filter with the node's reply policy, and returns the uuid and hop count of
+// the last lookup it sent along with the sellers that replied. With an
+// expanding ring, the first lookup only goes one hop, and the lookup is sent
+// again with one more hop each time no seller replies, until it reaches
+// MaxHops. With the deadline reply policy, the search also stops at the
+// deadline. A lookup the buyer stops collecting replies to early is
+// cancelled.
+func (bnode *BazaarNode) search(target string, filter nodeconfig.LookupFilter) (int64, int, []Offer) {
+
+	// DHT lookups do not use the hop count, so there is no ring to expand
+	hopcount := bnode.config.MaxHops
+	if bnode.config.ExpandingRing && hopcount > 1 && bnode.searchStrategy() != nodeconfig.SearchDHT {
+		hopcount = 1
+	}
+
+	var deadline time.Time
+	if bnode.config.ReplyPolicy == nodeconfig.ReplyPolicyDeadline {
+		deadline = time.Now().Add(bnode.config.ReplyDeadline)
+	}
+
+	for {
+		// each ring is a new lookup, so nodes that saw the previous ring do
+		// not drop it
+		lookupUUID := bnode.GetLookupUUID()
+		args := LookupArgs{
+			ProductName: target,
+			HopCount:    hopcount,
+			BuyerID:     bnode.config.NodeID,
+			Route:       []nodeconfig.Peer{},
+			UUID:        lookupUUID,
+			Filter:      filter,
+			Started:     time.Now(),
+			Trace:       bnode.startTrace(),
+		}
+
+		// only lookups under the deadline policy expire, since the other
+		// policies take late replies to the next lookup's cache
+		until := args.Started.Add(bnode.replyTimeout())
+		if !deadline.IsZero() {
+			if deadline.Before(until) {
+				until = deadline
+			}
+			args.deadline = until
+		}
+
+		replies := bnode.openReplies(lookupUUID)
+		go bnode.startLookup(args)
+		// log.Printf("Waiting to retrieve sellers...")
+		sellers, early := bnode.collectReplies(lookupUUID, replies, until, bnode.replyCount())
+
+		// the lookup is cancelled as soon as the buyer has the replies it
+		// wants. A lookup that ran until its deadline is not, since it has
+		// stopped by itself.
+		if early {
+			bnode.cancelBuyerLookup(lookupUUID, hopcount)
+		}
+
+		outOfTime := !deadline.IsZero() && !time.Now().Before(deadline)
+		if len(sellers) != 0 || hopcount >= bnode.config.MaxHops || outOfTime {
+			if bnode.config.ExpandingRing && len(sellers) != 0 {
+				bnode.reportRing(hopcount)
+			}
+			return lookupUUID, hopcount, sellers
+		}
+
+		if bnode.VerboseLogging {
+			log.Printf("Node %d found no sellers of %s within %d hops, expanding the ring", bnode.config.NodeID, target, hopcount)
+		}
+		hopcount++
+	}
+}
+
+// forwardWalker sends the walker on to a neighbour that is not on its route
+// yet, picked at random. The walker stops if it has visited every neighbour.
+func (bnode *BazaarNode) forwardWalker(args LookupArgs) {
+	peer, ok := bnode.nextWalkerPeer(args.Route)
+	if !ok {
+		if bnode.VerboseLogging {
+			log.Printf("Node %d has no unvisited neighbours for walker %d of lookup %d from %d", bnode.config.NodeID, args.Walker, args.UUID, args.BuyerID)
+		}
+		return
+	}
+
+	go bnode.callLookupRPC(peer, args)
+}
+
+// nextWalkerPeer picks a random neighbour that is not on the route, and
+// returns false if there is none.
+func (bnode *BazaarNode) nextWalkerPeer(route []nodeconfig.Peer) (nodeconfig.Peer, bool) {
+	visited := make(map[int]bool, len(route))
+	for _, routePeer := range route {
+		visited[routePeer.PeerID] = true
+	}
+
+	var unvisited []nodeconfig.Peer
+	for peer, addr := range bnode.config.Peers {
+		if !visited[peer] {
+			unvisited = append(unvisited, nodeconfig.Peer{PeerID: peer, Addr: addr})
+		}
+	}
+	if len(unvisited) == 0 {
+		return nodeconfig.Peer{}, false
+	}
+
+	return unvisited[rand.Intn(len(unvisited))], true
+}
+
+// countLookupMessage counts a lookup RPC sent by the node, and logs the total
+// every 500 messages, so the message cost of the search strategies can be
+// compared.
+func (bnode *BazaarNode) countLookupMessage() {
+	bnode.perfLock.Lock()
+	defer bnode.perfLock.Unlock()
+
+	bnode.state.LookupMessages++
+	if bnode.state.LookupMessages%500 == 0 {
+		log.Printf("🔎🔎🔎 Node %d has sent %d lookup messages 🔎🔎🔎", bnode.config.NodeID, bnode.state.LookupMessages)
+	}
+}
+
+// countExpiredLookup counts a lookup the node dropped because it was past its
+// deadline, and logs the total every 100 lookups.
+func (bnode *BazaarNode) countExpiredLookup(args LookupArgs) {
+	if bnode.VerboseLogging {
+		log.Printf("Node %d is dropping lookup %d from %d for %s, its deadline has passed", bnode.config.NodeID, args.UUID, args.BuyerID, args.ProductName)
+	}
+
+	bnode.perfLock.Lock()
+	defer bnode.perfLock.Unlock()
+
+	bnode.state.ExpiredLookups++
+	if bnode.state.ExpiredLookups%100 == 0 {
+		log.Printf("🔎🔎🔎 Node %d has dropped %d lookups past their deadline 🔎🔎🔎", bnode.config.NodeID, bnode.state.ExpiredLookups)
+	}
+}
+
+// reportSearch counts a lookup started by the buyer, and whether it got any
+// replies. The success rate of the node's search strategy is logged every 50
+// lookups.
+func (bnode *BazaarNode) reportSearch(answered bool) {
+	bnode.perfLock.Lock()
+	defer bnode.perfLock.Unlock()
+
+	bnode.state.LookupsIssued++
+	if answered {
+		bnode.state.LookupsAnswered++
+	}
+
+	if bnode.state.LookupsIssued%50 == 0 {
+		successRate := float64(bnode.state.LookupsAnswered) / float64(bnode.state.LookupsIssued)
+		log.Printf("🔎🔎🔎 Node %d %s search success rate: %f over %d lookups 🔎🔎🔎", bnode.config.NodeID, bnode.searchStrategy(), successRate, bnode.state.LookupsIssued)
+	}
+}
+
+// reportRing counts a lookup that found sellers within the given number of
+// hops, and logs the average radius of the expanding ring every 50 lookups.
+func (bnode *BazaarNode) reportRing(hopcount int) {
+	bnode.perfLock.Lock()
+	defer bnode.perfLock.Unlock()
+
+	bnode.state.RingLookups++
+	bnode.state.RingRadius += hopcount
+
+	if bnode.state.RingLookups%50 == 0 {
+		averageRadius := float64(bnode.state.RingRadius) / float64(bnode.state.RingLookups)
+		log.Printf("🔎🔎🔎 Node %d average expanding ring radius: %f over %d lookups 🔎🔎🔎", bnode.config.NodeID, averageRadius, bnode.state.RingLookups)
+	}
+}
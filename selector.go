@@ -0,0 +1,211 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/rjected/bazaar/nodeconfig"
+)
+
+// latencyWeight is the weight a new sell request latency gets in a seller's
+// moving average.
+const latencyWeight = 0.3
+
+// SellerSelector picks the seller a buyer tries to buy from first, out of the
+// offers it collected for a lookup. Select returns the index of the offer, and
+// is only called with at least one offer.
+type SellerSelector interface {
+	Select(offers []Offer) int
+}
+
+// newSellerSelector returns the seller selector for the strategy. The
+// selectors that rank sellers by how they did before use the stats and the
+// reputation table.
+func newSellerSelector(strategy string, stats *sellerStats, reputation *reputationTable) (SellerSelector, error) {
+	switch strategy {
+	case "", nodeconfig.SelectRandom:
+		return randomSelector{}, nil
+	case nodeconfig.SelectFewestHops:
+		return fewestHopsSelector{}, nil
+	case nodeconfig.SelectLowestLatency:
+		return lowestLatencySelector{stats: stats}, nil
+	case nodeconfig.SelectLowestPrice:
+		return lowestPriceSelector{}, nil
+	case nodeconfig.SelectRoundRobin:
+		return &roundRobinSelector{last: -1, lock: &sync.Mutex{}}, nil
+	case nodeconfig.SelectReputation:
+		return reputationSelector{reputation: reputation}, nil
+	default:
+		return nil, fmt.Errorf("unknown seller selection %q, the seller selection must be %q, %q, %q, %q, %q or %q", strategy, nodeconfig.SelectRandom, nodeconfig.SelectFewestHops, nodeconfig.SelectLowestLatency, nodeconfig.SelectLowestPrice, nodeconfig.SelectRoundRobin, nodeconfig.SelectReputation)
+	}
+}
+
+// selectLowest returns the index of the offer with the lowest score. Ties are
+// broken at random, so equally good sellers share the buyer's purchases.
+func selectLowest(offers []Offer, score func(Offer) float64) int {
+	var best []int
+	var bestScore float64
+	for i, offer := range offers {
+		offerScore := score(offer)
+		if len(best) == 0 || offerScore < bestScore {
+			best = []int{i}
+			bestScore = offerScore
+		} else if offerScore == bestScore {
+			best = append(best, i)
+		}
+	}
+
+	return best[rand.Intn(len(best))]
+}
+
+// randomSelector picks a seller at random.
+type randomSelector struct{}
+
+func (randomSelector) Select(offers []Offer) int {
+	return rand.Intn(len(offers))
+}
+
+// fewestHopsSelector picks the seller that is the fewest hops away.
+type fewestHopsSelector struct{}
+
+func (fewestHopsSelector) Select(offers []Offer) int {
+	return selectLowest(offers, func(offer Offer) float64 {
+		return float64(offer.Hops)
+	})
+}
+
+// lowestPriceSelector picks the seller with the lowest price.
+type lowestPriceSelector struct{}
+
+func (lowestPriceSelector) Select(offers []Offer) int {
+	return selectLowest(offers, func(offer Offer) float64 {
+		return float64(offer.Price)
+	})
+}
+
+// lowestLatencySelector picks the seller whose sell requests have been the
+// fastest. Sellers without a latency yet count as the fastest, so they get
+// tried.
+type lowestLatencySelector struct {
+	stats *sellerStats
+}
+
+func (selector lowestLatencySelector) Select(offers []Offer) int {
+	return selectLowest(offers, func(offer Offer) float64 {
+		return selector.stats.latency(offer.Seller.PeerID)
+	})
+}
+
+// reputationSelector picks the seller with the best reputation.
+type reputationSelector struct {
+	reputation *reputationTable
+}
+
+func (selector reputationSelector) Select(offers []Offer) int {
+	return selectLowest(offers, func(offer Offer) float64 {
+		return -selector.reputation.score(offer.Seller.PeerID)
+	})
+}
+
+// roundRobinSelector picks the seller with the lowest node id after the
+// seller it picked last, and wraps around to the lowest node id. This is
+// thread safe.
+type roundRobinSelector struct {
+	last int
+	lock *sync.Mutex
+}
+
+func (selector *roundRobinSelector) Select(offers []Offer) int {
+	selector.lock.Lock()
+	defer selector.lock.Unlock()
+
+	next, lowest := -1, 0
+	for i, offer := range offers {
+		sellerID := offer.Seller.PeerID
+		if sellerID < offers[lowest].Seller.PeerID {
+			lowest = i
+		}
+		if sellerID > selector.last && (next == -1 || sellerID < offers[next].Seller.PeerID) {
+			next = i
+		}
+	}
+	if next == -1 {
+		next = lowest
+	}
+
+	selector.last = offers[next].Seller.PeerID
+	return next
+}
+
+// sellerStats holds the moving average of the sell request latency, in
+// seconds, of each seller the buyer has bought from. This is thread safe.
+type sellerStats struct {
+	latencies map[int]float64
+	lock      *sync.Mutex
+}
+
+// newSellerStats creates empty seller stats.
+func newSellerStats() *sellerStats {
+	return &sellerStats{
+		latencies: make(map[int]float64),
+		lock:      &sync.Mutex{},
+	}
+}
+
+// record adds how long a sell request to the seller took.
+func (stats *sellerStats) record(sellerID int, latency time.Duration) {
+	stats.lock.Lock()
+	defer stats.lock.Unlock()
+
+	average, ok := stats.latencies[sellerID]
+	if !ok {
+		stats.latencies[sellerID] = latency.Seconds()
+		return
+	}
+	stats.latencies[sellerID] = average + latencyWeight*(latency.Seconds()-average)
+}
+
+// latency returns the seller's average sell request latency in seconds, or
+// zero if the buyer has not bought from the seller yet.
+func (stats *sellerStats) latency(sellerID int) float64 {
+	stats.lock.Lock()
+	defer stats.lock.Unlock()
+
+	return stats.latencies[sellerID]
+}
+
+// sellerSelection returns the seller selection strategy of the buyer.
+func (bnode *BazaarNode) sellerSelection() string {
+	if bnode.config.SellerSelection == "" {
+		return nodeconfig.SelectRandom
+	}
+	return bnode.config.SellerSelection
+}
+
+// reportPurchase counts a purchase the buyer started from the seller it
+// picked with its seller selection strategy, and whether it bought the whole
+// quantity. The completion rate, latency and price of the purchases are
+// written to the purchase log with the strategy after every purchase, and
+// logged every 50 purchases, so the strategies can be compared.
+func (bnode *BazaarNode) reportPurchase(offer Offer, duration time.Duration, completed bool) {
+	bnode.perfLock.Lock()
+	defer bnode.perfLock.Unlock()
+
+	bnode.state.Purchases++
+	if completed {
+		bnode.state.PurchasesCompleted++
+	}
+	bnode.state.PurchaseLatency += duration.Seconds()
+	bnode.state.PurchasePrice += offer.Price
+
+	purchases := float64(bnode.state.Purchases)
+	if bnode.PurchaseLogger != nil {
+		bnode.PurchaseLogger.Printf("%s %f %f %f %d", bnode.sellerSelection(), float64(bnode.state.PurchasesCompleted)/purchases, bnode.state.PurchaseLatency/purchases, float64(bnode.state.PurchasePrice)/purchases, bnode.state.Purchases)
+	}
+	if bnode.state.Purchases%50 == 0 {
+		log.Printf("🛒🛒🛒 Node %d %s seller selection: completion rate %f, average purchase latency %f, average price %f over %d purchases 🛒🛒🛒", bnode.config.NodeID, bnode.sellerSelection(), float64(bnode.state.PurchasesCompleted)/purchases, bnode.state.PurchaseLatency/purchases, float64(bnode.state.PurchasePrice)/purchases, bnode.state.Purchases)
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/rjected/bazaar/nodeconfig"
+	"gopkg.in/yaml.v2"
+)
+
+// SnapshotArgs is empty because no arguments are required for snapshot.
+type SnapshotArgs struct {
+}
+
+// SnapshotResponse contains the node's current config as YAML, and the path the
+// snapshot was written to. The path is empty if the node does not write
+// snapshots to disk.
+type SnapshotResponse struct {
+	Config []byte
+	Path   string
+}
+
+// Snapshot runs the snapshot command, which returns the node's current config
+// and writes it to the node's snapshot path.
+func (bnode *BazaarNode) Snapshot(args SnapshotArgs, reply *SnapshotResponse) error {
+	config, err := bnode.snapshot()
+	if err != nil {
+		return err
+	}
+
+	if bnode.SnapshotPath != "" {
+		err = writeSnapshot(bnode.SnapshotPath, config)
+		if err != nil {
+			return err
+		}
+		log.Printf("Node %d wrote snapshot to %s", bnode.config.NodeID, bnode.SnapshotPath)
+	}
+
+	*reply = SnapshotResponse{Config: config, Path: bnode.SnapshotPath}
+	return nil
+}
+
+// SaveSnapshot writes the node's current config to the given path, in the
+// format CreateNodeFromConfigFile accepts. Starting a node from the snapshot
+// continues from the items, balance, role and seller target the node has now.
+// Since the snapshot already includes every transaction in the node's ledger,
+// a node started from a snapshot must also start a new ledger, and
+// CreateNodeFromConfigPath refuses a snapshot with a ledger that has entries.
+func (bnode *BazaarNode) SaveSnapshot(path string) error {
+	config, err := bnode.snapshot()
+	if err != nil {
+		return err
+	}
+
+	return writeSnapshot(path, config)
+}
+
+// snapshot returns the node's current config as YAML, along with the number
+// of sales the node has made, so receipt ids stay unique. Items that are
+// reserved but not sold yet are counted as in stock, since the reservations do
+// not outlive the node.
+func (bnode *BazaarNode) snapshot() ([]byte, error) {
+
+	bnode.state.Mu.Lock()
+	bnode.walletLock.Lock()
+
+	config := bnode.config
+	config.Snapshot = true
+	config.ReceiptCount = bnode.receiptCount
+	config.Items = make([]nodeconfig.ItemAmount, len(bnode.config.Items))
+	copy(config.Items, bnode.config.Items)
+	for _, res := range bnode.reservations {
+		config.Items[bnode.findItem(res.item)].Amount += res.quantity
+	}
+
+	bnode.walletLock.Unlock()
+	bnode.state.Mu.Unlock()
+
+	return yaml.Marshal(&config)
+}
+
+// writeSnapshot writes the snapshot to a temporary file next to the path, and
+// then renames it, so a crash while writing never leaves a partial snapshot.
+func writeSnapshot(path string, config []byte) error {
+	temp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+
+	_, err = temp.Write(config)
+	if err == nil {
+		err = temp.Sync()
+	}
+	if closeErr := temp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(temp.Name())
+		return err
+	}
+
+	return os.Rename(temp.Name(), path)
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// The events a span records.
+const (
+	// SpanStart is recorded by the buyer when it sends the lookup.
+	SpanStart = "start"
+
+	// SpanLookup is recorded by every node that handles the lookup.
+	SpanLookup = "lookup"
+
+	// SpanOffer is recorded by the node that answers the lookup with an
+	// offer, which is either the seller or a node with the seller's catalog.
+	SpanOffer = "offer"
+
+	// SpanReply is recorded by every node the reply passes through on its
+	// way back to the buyer, including the buyer.
+	SpanReply = "reply"
+)
+
+// Span is a record of a lookup or its reply passing through a node, by the
+// node's clock.
+type Span struct {
+	Node  int       `json:"node"`
+	Event string    `json:"event"`
+	Time  time.Time `json:"time"`
+}
+
+// Trace is the spans a lookup and one of its replies recorded, in the order
+// they were recorded. Lookups are only traced if their buyer starts the trace.
+type Trace []Span
+
+// traced returns true if the trace was started.
+func (trace Trace) traced() bool {
+	return len(trace) != 0
+}
+
+// with returns a copy of the trace with a span for the node and event added,
+// or the trace as is if it was not started. The trace is copied because
+// lookups share it between the peers they are sent to.
+func (trace Trace) with(nodeID int, event string) Trace {
+	if !trace.traced() {
+		return trace
+	}
+	return append(trace[:len(trace):len(trace)], Span{Node: nodeID, Event: event, Time: time.Now()})
+}
+
+// String returns the trace as the nodes it went through, with the time since
+// the first span.
+func (trace Trace) String() string {
+	var hops []string
+	for _, span := range trace {
+		hops = append(hops, fmt.Sprintf("%s@%d +%s", span.Event, span.Node, span.Time.Sub(trace[0].Time)))
+	}
+	return strings.Join(hops, " -> ")
+}
+
+// TraceRecord is a trace the buyer exports once the reply reached it.
+type TraceRecord struct {
+	Lookup int64  `json:"lookup"`
+	Buyer  int    `json:"buyer"`
+	Seller int    `json:"seller"`
+	Item   string `json:"item"`
+	Spans  Trace  `json:"spans"`
+}
+
+// startTrace returns a trace with the buyer's start span if the buyer traces
+// its lookups, and an empty trace otherwise.
+func (bnode *BazaarNode) startTrace() Trace {
+	if !bnode.config.Trace {
+		return nil
+	}
+	return Trace{{Node: bnode.config.NodeID, Event: SpanStart, Time: time.Now()}}
+}
+
+// exportTrace writes the reply's trace to the node's trace export, one JSON
+// object per line, and logs it if logging is verbose.
+func (bnode *BazaarNode) exportTrace(args ReplyArgs) {
+	if !args.Trace.traced() {
+		return
+	}
+
+	if bnode.VerboseLogging {
+		log.Printf("Node %d trace of lookup %d reply from seller node %d: %s", bnode.config.NodeID, args.LookupUUID, args.Offer.Seller.PeerID, args.Trace)
+	}
+
+	if bnode.TraceExport == nil {
+		return
+	}
+
+	line, err := json.Marshal(TraceRecord{
+		Lookup: args.LookupUUID,
+		Buyer:  bnode.config.NodeID,
+		Seller: args.Offer.Seller.PeerID,
+		Item:   args.Offer.Item,
+		Spans:  args.Trace,
+	})
+	if err != nil {
+		log.Printf("Node %d failed to export trace of lookup %d: %s", bnode.config.NodeID, args.LookupUUID, err)
+		return
+	}
+	line = append(line, '\n')
+
+	bnode.traceLock.Lock()
+	defer bnode.traceLock.Unlock()
+
+	_, err = bnode.TraceExport.Write(line)
+	if err != nil {
+		log.Printf("Node %d failed to export trace of lookup %d: %s", bnode.config.NodeID, args.LookupUUID, err)
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+// balance returns the node's current balance. This is thread safe.
+func (bnode *BazaarNode) balance() int {
+	bnode.walletLock.Lock()
+	defer bnode.walletLock.Unlock()
+	return bnode.config.Balance
+}
+
+// withdraw takes the amount out of the node's balance, returning false and
+// leaving the balance untouched if the node cannot afford it. Buyers withdraw
+// the payment before calling the seller, so concurrent purchases can never
+// spend more than the node has. This is thread safe.
+func (bnode *BazaarNode) withdraw(amount int) bool {
+	bnode.walletLock.Lock()
+	defer bnode.walletLock.Unlock()
+
+	if amount > bnode.config.Balance {
+		return false
+	}
+	bnode.config.Balance -= amount
+	return true
+}
+
+// withdrawUpTo takes the amount out of the node's balance, or the whole
+// balance if the node cannot afford the amount, and returns how much it took.
+// This is thread safe.
+func (bnode *BazaarNode) withdrawUpTo(amount int) int {
+	bnode.walletLock.Lock()
+	defer bnode.walletLock.Unlock()
+
+	if amount > bnode.config.Balance {
+		amount = bnode.config.Balance
+	}
+	bnode.config.Balance -= amount
+	return amount
+}
+
+// deposit adds the amount to the node's balance. Sellers deposit while holding
+// the node lock, so the wallet lock must never be held while taking the node
+// lock. This is thread safe.
+func (bnode *BazaarNode) deposit(amount int) {
+	bnode.walletLock.Lock()
+	bnode.config.Balance += amount
+	bnode.walletLock.Unlock()
+}